@@ -2,110 +2,891 @@ package main
 
 import (
 	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
 	"os"
-	"sort"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"runtime/debug"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
-	"os/signal"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+
+	"github.com/XsiaX/Golang-2/sorter"
 )
 
-type Node struct {
-	data  []string
-	left  *Node
-	right *Node
-}
-type Tree struct {
-	root *Node
-}
+// autoDelim is the delimiter detected from the first input read with -t auto,
+// all the inputs are read and written with it.
+var (
+	autoDelim     string
+	autoDelimOnce sync.Once
+)
+
+// skippedFiles counts the input files -skip-errors skipped.
+var skippedFiles atomic.Int32
+
+// filesRead counts the input files read, for -progress.
+var filesRead atomic.Int32
+
+// version is set at build time with -ldflags "-X main.version=..."
+var version = "dev"
 
 var (
-	sorted         [][]string
-	dir            = flag.String("d", "", "Specifies a directory where it must read input files from")
-	inputFileName  = flag.String("i", "", "Use a file with the name file-name as an input")
+	versionFlag    = flag.Bool("version", false, "Print the program version and exit")
+	dirs           = listFlag("d", "Read the input files from the `directory`, repeat the flag or use a comma-separated list for several")
+	inputFileNames = listFlag("i", "Use a file with the name `file-name` as an input, repeat the flag or use a comma-separated list for several files, - reads stdin")
 	outputFileName = flag.String("o", "", "Use a file with the name file-name as an output")
 	headerFlag     = flag.Bool("h", false, "Remove headers from sorting")
 	reverseFlag    = flag.Bool("r", false, "Sort input lines in reverse order")
-	fieldFlag      = flag.Int("f", 0, "Sort input lines by value number N")
-	algorithmFlag  = flag.Int("a", 1, "Sorting algorithm: 1 - built in, 2 - Tree Sort")
+	fieldNameFlag  = flag.String("field-name", "", "Sort input lines by the value in the column with this header name, implies -h")
+	fieldFlag      = flag.String("f", "0", "Sort input lines by value number N, -1 for the last one, a comma-separated list N1,N2,... breaks ties by the next value, N:desc sorts by N in descending order")
+	algorithmFlag  = flag.String("a", "builtin", "Sorting `algorithm`: builtin, tree or merge, the external merge sort for inputs larger than memory")
+	chunkFlag      = flag.Int("chunk", sorter.DefaultChunk, "Number of lines the external merge sort (-a merge) keeps in memory")
+	numericFlag    = flag.Bool("n", false, "Compare the sort field as a number")
+	caseFlag       = flag.Bool("c", false, "Ignore case when comparing the sort field")
+	naturalFlag    = flag.Bool("natural", false, "Compare numbers inside the sort field by value, so file2 goes before file10")
+	uniqueFlag     = flag.Bool("u", false, "Output only the first of identical lines")
+	countFlag      = flag.Bool("count", false, "Prefix unique lines with the number of their occurrences")
+	stableFlag     = flag.Bool("stable", false, "Keep the input order of lines with equal keys (built in sort)")
+	delimiterFlag  = flag.String("t", ",", "Use the string as a field delimiter, \\t stands for a tab, auto detects it from the first lines")
+	recursiveFlag  = flag.Bool("R", false, "Read files from subdirectories of -d too")
+	extFlag        = flag.String("ext", ".csv", "Read only files with these comma-separated extensions from -d, empty for all files")
+	workersFlag    = flag.Int("w", 3, "Number of goroutines reading files from -d")
+	formatFlag     = flag.String("format", "csv", "Output format: csv, tsv, json - an array of arrays, json-objects - an array of objects keyed by the header (needs -h), table - columns aligned for reading")
+	maxLineFlag    = flag.Int("maxline", sorter.DefaultMaxLine, "Maximum length of an input line in bytes")
+	skipBlankFlag  = flag.Bool("skip-blank", false, "Skip blank lines, otherwise they are an error")
+	appendFlag     = flag.Bool("append", false, "Append to the -o file instead of overwriting it, the header is written only to an empty file")
+	checkFlag      = flag.Bool("check", false, "Only validate the input and report problems, exit with 1 if there are any")
+	colsFlag       = flag.String("cols", "", "Output only these comma-separated fields, in this order")
+	headFlag       = flag.Int("head", 0, "Output only the first N sorted lines")
+	tailFlag       = flag.Int("tail", 0, "Output only the last N sorted lines")
+	grepFlag       = filterFlag("grep", "Sort only lines with the field N matching the regular expression, given as `N=pattern`, several flags must all match")
+	trimFlag       = flag.Bool("trim", false, "Remove the whitespace around fields before sorting and output")
+	quoteFlag      = flag.String("quote", `"`, "Use the character to quote fields with a single character delimiter")
+	dateFlag       = flag.String("date", "", "Compare fields as dates in the Go `layout`, like 02/01/2006")
+	shuffleFlag    = flag.Bool("shuffle", false, "Put the lines in a random order instead of sorting them")
+	seedFlag       = flag.Int64("seed", 0, "Seed the random order of -shuffle to repeat it, a new one every run if not set")
+	parallelFlag   = flag.Bool("parallel", false, "Sort on all the CPUs, keeping equal lines in their input order")
+	benchFlag      = flag.Bool("bench", false, "Time every sorting algorithm on the input and print the results instead of the sorted lines")
+	widthsFlag     = flag.String("widths", "", "Read fixed-width fields of these comma-separated `widths` in bytes instead of delimited ones")
+	outWidthsFlag  = flag.String("out-widths", "", "Write fields padded to these comma-separated `widths` instead of delimited")
+	encodingFlag   = flag.String("encoding", "utf-8", "Read input in the `encoding`: utf-8, utf-16 (with a BOM), utf-16le, utf-16be or latin1")
+	commentFlag    = flag.String("comment", "", "Skip lines starting with this character, after any spaces")
+	blanksFlag     = flag.Bool("b", false, "Ignore leading blanks when comparing fields")
+	keyStartFlag   = flag.Int("key-start", 0, "Compare fields from this byte on, counting from 0")
+	keyEndFlag     = flag.Int("key-end", 0, "Compare fields up to, but not including, this byte, to the end if 0")
+	crlfFlag       = flag.Bool("crlf", false, "End output lines with \\r\\n, like on Windows")
+	outDelimFlag   = flag.String("ot", "", "Use the string as the output field delimiter instead of the -t one, \\t stands for a tab")
+	transposeFlag  = flag.Bool("transpose", false, "Swap lines and columns before sorting, the columns are then sorted as lines")
+	numberFlag     = flag.Bool("number", false, "Prefix the sorted lines with their number, the header with \"number\"")
+	autoHeaderFlag = flag.Bool("detect-header", false, "Treat the first line as a header, like -h, if it has no numbers while a column below it has only numbers")
+	statsFlag      = flag.Bool("stats", false, "Print statistics of the sort to stderr")
+	nullsFlag      = flag.String("nulls", "", "Put lines with a null sort field `first or last`, whatever the order")
+	nullValueFlag  = flag.String("null-value", "", "Treat sort fields equal to this value as null for -nulls, empty ones by default")
+	raggedFlag     = flag.Bool("ragged", false, "Allow lines with different numbers of columns, padding the shorter ones with empty fields")
+	teeFlag        = flag.Bool("tee", false, "Write the sorted lines to stdout as well as to the -o file")
+	localeFlag     = flag.String("locale", "", "Collate text in the language of the BCP 47 `tag`, like de or sv, instead of comparing bytes")
+	monthFlag      = flag.Bool("month", false, "Compare fields as month names, like Jan or January, in the order of the months")
+	semverFlag     = flag.Bool("version-sort", false, "Compare fields as dotted versions, so 1.2.9 goes before 1.2.10")
+	ipFlag         = flag.Bool("ip", false, "Compare fields as IPv4 or IPv6 addresses")
+	thousandsFlag  = flag.String("thousands", "", "Drop this thousands separator from numbers with -n, like in 1,234.50")
+	unitsFlag      = flag.Bool("units", false, "With -n, multiply numbers ending in K, M or G by 1000, a million or a billion")
+	orderedFlag    = flag.Bool("deterministic", false, "Read the -d files in the order of their names, so with -stable equal lines come out file by file and line by line")
+	skipErrorsFlag = flag.Bool("skip-errors", false, "Report input files that can't be opened or read and go on without them, exit with 1 at the end")
+	checksumFlag   = flag.Bool("checksum", false, "Print the SHA-256 of the output to stderr, to check that runs give the same output")
+	sidecarFlag    = flag.Bool("checksum-file", false, "Write the SHA-256 of the -o file next to it, in the file name with .sha256, like sha256sum does")
+	mergeFlag      = flag.Bool("merge", false, "Merge input files that are each sorted already, without sorting them again, and fail on a line out of order")
+	colWidthFlag   = flag.Int("max-col-width", 0, "Cut the cells of -format table to this many characters, marking the cut with …")
+	progressFlag   = flag.Bool("progress", false, "Print the number of files and lines read so far to stderr every second while reading")
+	fromFlag       = flag.Int("from", 0, "Sort only the lines from line N on, counting from 1 without the header")
+	toFlag         = flag.Int("to", 0, "Sort only the lines up to and including line N")
+	timeoutFlag    = flag.Duration("timeout", 0, "Fail reading an input, like a FIFO, that sends nothing for this long, like 30s, 0 waits forever")
+	headLinesFlag  = flag.Int("header-lines", 0, "Keep the first N lines on top and out of sorting, like -h does for one")
+	allowDupsFlag  = flag.Bool("allow-dup-headers", false, "Let -field-name take the first of columns with the same name instead of failing")
+	byLengthFlag   = flag.Bool("by-length", false, "Compare fields by their length in characters, equal lengths by value, -r puts the longest first")
+	isSortedFlag   = flag.Bool("is-sorted", false, "Only check that the input is sorted already, exit with 1 and the first line out of order if not")
+	zOutFlag       = flag.Bool("z-out", false, "Compress the output to stdout with gzip, -o files ending in .gz are always compressed")
+	hashFlag       = flag.Bool("hash-sort", false, "Order lines by a hash of the sort field, a random order that is the same every run")
+	bucketsFlag    = flag.Int("buckets", 0, "Add a column with the hash of the sort field modulo N, to split the lines into N shards")
+	groupByFlag    = flag.String("group-by", "", "Output one line for each run of lines with equal values of these comma-separated fields, sorting by them without -f")
+	aggFlag        = flag.String("agg", "", "With -group-by, set the fields of each line to `func:N,...` of the field N of the group: sum, count, first or last")
+	rejectFlag     = flag.String("reject-file", "", "Write lines with the wrong number of columns, or a sort field that isn't a number with -n, to this file instead of failing")
+	describeFlag   = flag.Bool("describe", false, "Only print the type, smallest and largest value, distinct and null count of every column")
+	limitFlag      = flag.Int("limit", 0, "Stop reading after N lines, not counting the header, and sort only those, to try things on a sample of a large input")
+	gzipFlag       = flag.Bool("z", false, "Decompress gzip input from stdin, files ending in .gz are always decompressed")
 )
 
+// sortedRows are the rows being written, closed on the second signal too so
+// the merge sort's temporary files are removed.
+var sortedRows atomic.Pointer[sorter.Rows]
+
 func main() {
+	flag.Usage = usage
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	sigchnl := make(chan os.Signal, 1)
-	signal.Notify(sigchnl)
+	signal.Notify(sigchnl, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		for {
 			s := <-sigchnl
-			handler(s)
+			handler(ctx, cancel, s)
 		}
 	}()
-	
-	contChan := make(chan []string)
+
+	contChan := make(chan readRow)
 	flag.Parse()
 
+	if *versionFlag {
+		fmt.Println(versionInfo())
+		return
+	}
+
+	delim := parseDelimiter(*delimiterFlag)
+	if delim == "" {
+		log.Fatal("ERROR: The delimiter can't be empty")
+	}
+
+	quote, size := utf8.DecodeRuneInString(*quoteFlag)
+	if size == 0 || size != len(*quoteFlag) {
+		log.Fatal("ERROR: The quote must be a single character")
+	}
+
+	var comment rune
+	if *commentFlag != "" {
+		var size int
+		if comment, size = utf8.DecodeRuneInString(*commentFlag); size != len(*commentFlag) {
+			log.Fatal("ERROR: The comment must be a single character")
+		}
+	}
+
+	fields, orders, err := parseKeys(*fieldFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var columns []int
+	if *colsFlag != "" {
+		if columns, err = parseFields(*colsFlag); err != nil {
+			log.Fatal(err)
+		}
+	}
+	var groupBy []int
+	if *groupByFlag != "" {
+		if groupBy, err = parseFields(*groupByFlag); err != nil {
+			log.Fatal(err)
+		}
+		if !isFlagPassed("f") && !isFlagPassed("field-name") {
+			fields = groupBy
+		}
+	}
+	aggs, err := parseAggs(*aggFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var widths, outWidths []int
+	if *widthsFlag != "" {
+		if widths, err = parseWidths(*widthsFlag); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *outWidthsFlag != "" {
+		if outWidths, err = parseWidths(*outWidthsFlag); err != nil {
+			log.Fatal(err)
+		}
+	}
+	algorithm := *algorithmFlag
+	if name, ok := algorithmAliases[algorithm]; ok {
+		fmt.Fprintf(os.Stderr, "WARNING: -a %s is deprecated, use -a %s\n", algorithm, name)
+		algorithm = name
+	}
+	seed := time.Now().UnixNano()
+	if isFlagPassed("seed") {
+		seed = *seedFlag
+	}
+	opts := sorter.Options{
+		Fields:     fields,
+		Orders:     orders,
+		Nulls:      *nullsFlag,
+		NullValue:  *nullValueFlag,
+		FieldName:  *fieldNameFlag,
+		AllowDups:  *allowDupsFlag,
+		Header:     *headerFlag,
+		AutoHeader: *autoHeaderFlag,
+		HeadLines:  *headLinesFlag,
+		Delimiter:  delim,
+		OutDelim:   parseDelimiter(*outDelimFlag),
+		MaxLine:    *maxLineFlag,
+		SkipBlank:  *skipBlankFlag,
+		Ragged:     *raggedFlag,
+		Trim:       *trimFlag,
+		Comment:    comment,
+		Encoding:   *encodingFlag,
+		Widths:     widths,
+		OutWidths:  outWidths,
+		Quote:      quote,
+		Algorithm:  algorithm,
+		Chunk:      *chunkFlag,
+		Numeric:    *numericFlag,
+		Thousands:  *thousandsFlag,
+		Units:      *unitsFlag,
+		IgnoreCase: *caseFlag,
+		Blanks:     *blanksFlag,
+		KeyStart:   *keyStartFlag,
+		KeyEnd:     *keyEndFlag,
+		Natural:    *naturalFlag,
+		Version:    *semverFlag,
+		DateLayout: *dateFlag,
+		Month:      *monthFlag,
+		IP:         *ipFlag,
+		Locale:     *localeFlag,
+		ByLength:   *byLengthFlag,
+		Hash:       *hashFlag,
+		Buckets:    *bucketsFlag,
+		Stable:     *stableFlag,
+		Parallel:   *parallelFlag,
+		Shuffle:    *shuffleFlag,
+		Transpose:  *transposeFlag,
+		Seed:       seed,
+		Unique:     *uniqueFlag,
+		Count:      *countFlag,
+		GroupBy:    groupBy,
+		Aggs:       aggs,
+		Format:     *formatFlag,
+		MaxWidth:   *colWidthFlag,
+		CRLF:       *crlfFlag,
+		Columns:    columns,
+		From:       *fromFlag,
+		To:         *toFlag,
+		Limit:      *limitFlag,
+		Head:       *headFlag,
+		Tail:       *tailFlag,
+		Number:     *numberFlag,
+		Filters:    *grepFlag,
+	}
+	if *reverseFlag {
+		opts.Order = sorter.Descending
+	}
+	start := time.Now()
+	if *statsFlag {
+		opts.Stats = &sorter.Stats{}
+	}
+	if err := opts.Validate(); err != nil {
+		log.Fatal("ERROR: ", err)
+	}
+	if *rejectFlag != "" {
+		f, err := os.Create(*rejectFlag)
+		if err != nil {
+			log.Fatal("ERROR: ", err)
+		}
+		rejects = &rejectFile{f: f, bw: bufio.NewWriter(f), opts: opts}
+		opts.Reject = rejects.reject
+		defer rejects.close()
+	}
+	if *checkFlag {
+		// rows the reader refuses are problems to report, not to stop at
+		reject := opts.Reject
+		opts.Reject = func(row []string, err error) {
+			readProblems.add(err.Error())
+			if reject != nil {
+				reject(row, err)
+			}
+		}
+	}
+
+	if *teeFlag && !isFlagPassed("o") {
+		log.Fatal("ERROR: -tee needs an output file set with -o")
+	}
+	if *sidecarFlag && (!isFlagPassed("o") || *appendFlag) {
+		log.Fatal("ERROR: -checksum-file needs an output file set with -o and can't be used with -append")
+	}
+
+	// -limit stops the reading stages without interrupting the program
+	readCtx, cancelReading := context.WithCancel(ctx)
+	defer cancelReading()
+	stopReading = cancelReading
+
 	if isFlagPassed("d") && isFlagPassed("i") {
 		log.Fatal("ERROR: You can't use -d and -i flags at the same time")
+	} else if *mergeFlag {
+		if opts.Shuffle || opts.Transpose || opts.AutoHeader || opts.Limit > 0 {
+			log.Fatal("ERROR: -merge can't be used with -shuffle, -transpose, -detect-header or -limit")
+		}
+		if *checkFlag || *benchFlag || *isSortedFlag || *describeFlag || *statsFlag {
+			log.Fatal("ERROR: -merge only writes the merged lines, it can't be used with -check, -bench, -is-sorted, -describe or -stats")
+		}
+		if err := output(merge(ctx, opts), opts); err != nil {
+			log.Fatal(err)
+		}
+		rejects.close()
+		exitIfSkipped()
+		return
 	} else if isFlagPassed("d") {
-		fnChan := readDir(dir)
-		contChan = fileReadinStage(fnChan, 3)
+		if *workersFlag < 1 {
+			log.Fatal("ERROR: The number of workers must be at least 1")
+		}
+		fnChan := readDir(readCtx, *dirs, *recursiveFlag, parseExtensions(*extFlag))
+		if *orderedFlag {
+			contChan = orderedReadinStage(readCtx, fnChan, *workersFlag, opts)
+		} else {
+			contChan = fileReadinStage(readCtx, fnChan, *workersFlag, opts)
+		}
 	} else {
-		contChan = input()
+		contChan = input(readCtx, opts)
+	}
+	if *progressFlag {
+		var reported chan struct{}
+		contChan, reported = withProgress(readCtx, contChan)
+		stopReading = func() {
+			cancelReading()
+			<-reported
+		}
+	}
+
+	// every mode reads the lines the way sorting them does
+	next := receive(ctx, contChan)
+	if *checkFlag {
+		check(next, opts)
+		return
+	}
+	if *benchFlag {
+		bench(next, opts)
+		return
 	}
+	if *isSortedFlag {
+		isSorted(next, opts)
+		return
+	}
+	if *describeFlag {
+		describe(next, opts)
+		return
+	}
+
+	sorted, err := sorter.SortStream(next, opts)
+	stopReading()
+	if err != nil {
+		log.Fatal("ERROR: ", err)
+	}
+	sortedRows.Store(sorted)
+	err = output(sorted, opts)
+	sorted.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if opts.Stats != nil {
+		printStats(opts, time.Since(start))
+	}
+	if ctx.Err() != nil {
+		fmt.Fprintln(os.Stderr, "Program will terminate now.")
+		os.Exit(1)
+	}
+	rejects.close()
+	exitIfSkipped()
+}
+
+// rejects is the -reject-file, nil without one.
+var rejects *rejectFile
 
-	sortContent(contChan, *headerFlag, *fieldFlag, *reverseFlag, *algorithmFlag)
-	output(sorted)
+// rejectFile writes the rows Options.Reject takes to the -reject-file, with
+// the delimiter and quote they were read with.
+type rejectFile struct {
+	mu   sync.Mutex // the -d workers reject rows at the same time
+	f    *os.File
+	bw   *bufio.Writer
+	w    sorter.RowWriter
+	opts sorter.Options
+	n    int
 }
 
-func handler(signal os.Signal) {
+func (r *rejectFile) reject(row []string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.w == nil {
+		// with -t auto the delimiter is detected by now
+		opts := sorter.Options{Delimiter: r.opts.Delimiter, Quote: r.opts.Quote, OutWidths: r.opts.Widths, CRLF: r.opts.CRLF}
+		if opts.Delimiter == sorter.AutoDelimiter {
+			opts.Delimiter = autoDelim
+		}
+		r.w = sorter.NewRowWriter(r.bw, opts)
+	}
+	if err := r.w.Write(row); err != nil {
+		log.Fatalf("ERROR: %s: %v", r.f.Name(), err)
+	}
+	r.n++
+}
+
+// close writes out the rejected rows and reports how many there were. It
+// does nothing on a nil or closed file.
+func (r *rejectFile) close() {
+	if r == nil || r.f == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.w != nil {
+		if err := r.w.Close(); err != nil {
+			log.Fatalf("ERROR: %s: %v", r.f.Name(), err)
+		}
+	}
+	if err := r.bw.Flush(); err != nil {
+		log.Fatalf("ERROR: %s: %v", r.f.Name(), err)
+	}
+	if err := r.f.Close(); err != nil {
+		log.Fatalf("ERROR: %s: %v", r.f.Name(), err)
+	}
+	if r.n > 0 {
+		fmt.Fprintf(os.Stderr, "WARNING: %d lines rejected to %s\n", r.n, r.f.Name())
+	}
+	r.f = nil
+}
+
+// exitIfSkipped exits with 1 if -skip-errors skipped any input files.
+func exitIfSkipped() {
+	if n := skippedFiles.Load(); n > 0 {
+		fmt.Fprintf(os.Stderr, "ERROR: input files skipped: %d\n", n)
+		os.Exit(1)
+	}
+}
+
+// stopReading stops the reading stages once the lines are read, or as many
+// as -limit takes, and waits for -progress to report how many were read.
+var stopReading = func() {}
+
+// withProgress passes the lines on, printing the number of files and lines
+// read so far to stderr every second and once more after the last line or
+// once ctx stops the reading. reported is closed after that.
+func withProgress(ctx context.Context, lines chan readRow) (out chan readRow, reported chan struct{}) {
+	out, reported = make(chan readRow), make(chan struct{})
+	go func() {
+		defer close(reported)
+		defer close(out)
+		tick := time.NewTicker(time.Second)
+		defer tick.Stop()
+		rows := 0
+		report := func(state string) {
+			fmt.Fprintf(os.Stderr, "%s: %d files, %d lines\n", state, filesRead.Load(), rows)
+		}
+		for {
+			select {
+			case line, ok := <-lines:
+				if !ok {
+					report("read")
+					return
+				}
+				select {
+				case out <- line:
+				case <-ctx.Done():
+					report("read")
+					return
+				}
+				if line.err == nil {
+					rows++
+				}
+			case <-tick.C:
+				report("reading")
+			case <-ctx.Done():
+				report("read")
+				return
+			}
+		}
+	}()
+	return out, reported
+}
+
+// printStats writes the statistics of the sort to stderr, to keep them out
+// of the output.
+func printStats(opts sorter.Options, elapsed time.Duration) {
+	st := opts.Stats
+	fmt.Fprintf(os.Stderr, "rows: %d\n", st.Rows)
+	fmt.Fprintf(os.Stderr, "columns: %d\n", st.Columns)
+	if opts.Unique || opts.Count {
+		fmt.Fprintf(os.Stderr, "duplicates: %d\n", st.Duplicates)
+	}
+	if st.Rows > 0 {
+		fmt.Fprintf(os.Stderr, "min: %s\n", st.Min)
+		fmt.Fprintf(os.Stderr, "max: %s\n", st.Max)
+	}
+	fmt.Fprintf(os.Stderr, "elapsed: %v\n", elapsed.Round(time.Microsecond))
+}
+
+// algorithmAliases are the numbers -a used to take instead of names.
+var algorithmAliases = map[string]string{"1": "builtin", "2": "tree", "3": "merge"}
+
+// bench sorts the input lines with every algorithm and prints how long each
+// took and whether it sorted them like the first one.
+func bench(next func() ([]string, bool), opts sorter.Options) {
+	rows := [][]string{}
+	for line, ok := next(); ok; line, ok = next() {
+		rows = append(rows, line)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ALGORITHM\tTIME\tOUTPUT")
+	var want [][]string
+	for _, a := range sorter.Algorithms() {
+		opts.Algorithm = a
+		if err := opts.Validate(); err != nil {
+			// the algorithm can't sort with these options
+			fmt.Fprintf(tw, "%s\t-\tskipped: %v\n", a, err)
+			continue
+		}
+		start := time.Now()
+		sorted, err := sorter.SortRows(append([][]string(nil), rows...), opts)
+		if err != nil {
+			log.Fatalf("ERROR: %s: %v", a, err)
+		}
+		got := [][]string{}
+		for row, err := sorted.Read(); err != io.EOF; row, err = sorted.Read() {
+			if err != nil {
+				sorted.Close()
+				log.Fatalf("ERROR: %s: %v", a, err)
+			}
+			got = append(got, row)
+		}
+		sorted.Close()
+		elapsed := time.Since(start)
+
+		result := "same"
+		if want == nil {
+			want = got
+		} else if !slices.EqualFunc(got, want, slices.Equal) {
+			// without -stable equal lines may come in any order
+			result = "differs"
+		}
+		fmt.Fprintf(tw, "%s\t%v\t%s\n", a, elapsed.Round(time.Microsecond), result)
+	}
+	tw.Flush()
+}
+
+// check validates the input lines without sorting them. The problems found
+// while reading, like a column mismatch inside a file or a file that can't
+// be read, come first.
+func check(next func() ([]string, bool), opts sorter.Options) {
+	report := sorter.CheckRows(next, opts)
+	stopReading()
+	problems := append(readProblems.all(), report.Problems...)
+	for _, p := range problems {
+		fmt.Fprintln(os.Stderr, "ERROR:", p)
+	}
+	fmt.Printf("%d rows, %d columns, %d problems\n", report.Rows, report.Columns, len(problems))
+	if len(problems) > 0 {
+		os.Exit(1)
+	}
+}
+
+// readProblems are the problems -check found while reading the input.
+var readProblems problemList
+
+// problemList collects problems from the reading stages.
+type problemList struct {
+	mu   sync.Mutex
+	list []string
+}
+
+func (p *problemList) add(problem string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.list = append(p.list, problem)
+}
+
+// all returns a copy of the problems collected so far.
+func (p *problemList) all() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return slices.Clone(p.list)
+}
+
+// describe prints what the columns of the input lines have in them, like
+// a quick profile of the file, without sorting them.
+func describe(next func() ([]string, bool), opts sorter.Options) {
+	columns := sorter.DescribeRows(next, opts)
+	stopReading()
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "COLUMN\tTYPE\tMIN\tMAX\tDISTINCT\tNULLS")
+	for _, c := range columns {
+		typ := "text"
+		if c.Numeric {
+			typ = "numeric"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%d\n", c.Name, typ, c.Min, c.Max, c.Distinct, c.Nulls)
+	}
+	tw.Flush()
+}
+
+// isSorted checks that the input lines are in sorted order already, and
+// exits with 1 after the first line that isn't.
+func isSorted(next func() ([]string, bool), opts sorter.Options) {
+	n, err := sorter.FirstUnsorted(next, opts)
+	stopReading()
+	if err != nil {
+		log.Fatal("ERROR: ", err)
+	}
+	if n > 0 {
+		fmt.Fprintf(os.Stderr, "ERROR: line %d is out of order\n", n)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Sorts lines of delimited files by one or more fields.\n\n")
+	fmt.Fprintf(out, "Usage: %s [flags]\n\n", os.Args[0])
+	flag.PrintDefaults()
+	fmt.Fprintf(out, `
+Algorithms (-a): builtin - built in sort, tree - Tree Sort, merge - external merge sort.
+The numbers 1, 2 and 3 still select them, but are deprecated.
+
+Examples:
+  Sort data.csv by its second field and keep the header on top:
+    %[1]s -i data.csv -f 1 -h
+  Sort all .csv files in the data directory numerically by the first field, in reverse:
+    %[1]s -d data -n -r -o sorted.csv
+  Sort with Tree Sort by the third field, breaking ties by the first:
+    %[1]s -i data.csv -f 2,0 -a tree
+`, os.Args[0])
+}
+
+// versionInfo describes the build, with the VCS revision when the binary
+// was built from a checkout.
+func versionInfo() string {
+	info := "version " + version
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	settings := map[string]string{}
+	for _, s := range bi.Settings {
+		settings[s.Key] = s.Value
+	}
+	if rev := settings["vcs.revision"]; rev != "" {
+		info += ", revision " + rev
+		if settings["vcs.modified"] == "true" {
+			info += " (modified)"
+		}
+	}
+	if t := settings["vcs.time"]; t != "" {
+		info += ", committed " + t
+	}
+	return info + ", " + bi.GoVersion
+}
+
+func parseFields(s string) ([]int, error) {
+	var fields []int
+	for _, f := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil {
+			return nil, fmt.Errorf("ERROR: Invalid field number %q", f)
+		}
+		fields = append(fields, n)
+	}
+	return fields, nil
+}
+
+// parseAggs parses the aggregations, each a function and a field number
+// like sum:2.
+func parseAggs(s string) ([]sorter.Aggregate, error) {
+	var aggs []sorter.Aggregate
+	if s == "" {
+		return nil, nil
+	}
+	for _, a := range strings.Split(s, ",") {
+		fn, f, ok := strings.Cut(strings.TrimSpace(a), ":")
+		n, err := strconv.Atoi(f)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("ERROR: Invalid aggregation %q, expected func:N", a)
+		}
+		aggs = append(aggs, sorter.Aggregate{Func: fn, Field: n})
+	}
+	return aggs, nil
+}
+
+// parseKeys parses the sort fields, each with an optional :asc or :desc.
+func parseKeys(s string) (fields []int, orders []sorter.Order, err error) {
+	for _, f := range strings.Split(s, ",") {
+		f, dir, _ := strings.Cut(strings.TrimSpace(f), ":")
+		n, err := strconv.Atoi(f)
+		if err != nil {
+			return nil, nil, fmt.Errorf("ERROR: Invalid field number %q", f)
+		}
+		switch dir {
+		case "", "asc":
+			orders = append(orders, sorter.Ascending)
+		case "desc":
+			orders = append(orders, sorter.Descending)
+		default:
+			return nil, nil, fmt.Errorf("ERROR: Invalid sort order %q, expected asc or desc", dir)
+		}
+		fields = append(fields, n)
+	}
+	return fields, orders, nil
+}
+
+func parseWidths(s string) ([]int, error) {
+	var widths []int
+	for _, f := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil {
+			return nil, fmt.Errorf("ERROR: Invalid field width %q", f)
+		}
+		widths = append(widths, n)
+	}
+	return widths, nil
+}
+
+func parseDelimiter(s string) string {
+	return strings.ReplaceAll(s, `\t`, "\t")
+}
+
+// handler cancels ctx on the first SIGTERM or SIGINT so that the lines read
+// so far are still sorted and written, and exits right away on the second.
+// Only those two signals are delivered, the runtime keeps the rest (like the
+// SIGURG it uses for preemption).
+func handler(ctx context.Context, cancel context.CancelFunc, signal os.Signal) {
+	if ctx.Err() != nil {
+		fmt.Fprintln(os.Stderr, "Closing.")
+		if r := sortedRows.Load(); r != nil {
+			r.Close()
+		}
+		os.Exit(1)
+	}
 	if signal == syscall.SIGTERM {
-		fmt.Println("Got kill signal. ")
-		fmt.Println("Program will terminate now.")
-		os.Exit(0)
-	} else if signal == syscall.SIGINT {
-		fmt.Println("Got CTRL+C signal.")
-		fmt.Println("Closing.")
-		os.Exit(0)
+		fmt.Fprintln(os.Stderr, "Got kill signal.")
 	} else {
-		fmt.Println("Ignoring signal: ", signal)
+		fmt.Fprintln(os.Stderr, "Got CTRL+C signal.")
 	}
+	fmt.Fprintln(os.Stderr, "Writing the lines read so far.")
+	cancel()
 }
 
-func readDir(dir *string) chan string {
+// readDir sends the names of the files in the dirs with one of the
+// extensions, a directory after the other.
+// It stops once ctx is cancelled, closing the channel either way.
+func readDir(ctx context.Context, dirs []string, recursive bool, exts []string) chan string {
 	fnames := make(chan string)
+	send := func(fn string) bool {
+		select {
+		case fnames <- fn:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
 	go func() {
-		if *dir != "" {
-			files, err := os.ReadDir(*dir)
-			if err != nil {
-				log.Fatal(err)
-			}
-			for _, file := range files {
-				fnames <- file.Name()
+		defer close(fnames)
+		for _, dir := range dirs {
+			if !sendDir(dir, recursive, exts, send) {
+				return
 			}
 		}
-		close(fnames)
 	}()
 	return fnames
 }
 
-func fileReadinStage(fnames chan string, n int) (allLines chan []string) {
-	lines := make([]chan []string, n)
-	allLines = make(chan []string)
+func parseExtensions(s string) (exts []string) {
+	for _, ext := range strings.Split(s, ",") {
+		if ext = strings.TrimSpace(ext); ext != "" {
+			exts = append(exts, ext)
+		}
+	}
+	return exts
+}
+
+// sendDir sends the names of the files in dir with one of the extensions,
+// joined to dir so files with the same name in other directories are read
+// too. It returns false once send does.
+func sendDir(dir string, recursive bool, exts []string, send func(fn string) bool) bool {
+	if dir == "" {
+		return true
+	}
+	if recursive {
+		stopped := false
+		// WalkDir doesn't follow symlinks to directories, so links can't loop
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.IsDir() && hasExtension(path, exts) && !send(path) {
+				stopped = true
+				return filepath.SkipAll
+			}
+			return nil
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		return !stopped
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, file := range files {
+		if file.IsDir() || !hasExtension(file.Name(), exts) {
+			continue
+		}
+		if !send(filepath.Join(dir, file.Name())) {
+			return false
+		}
+	}
+	return true
+}
+
+// hasExtension reports whether the file name ends in one of exts, looking
+// past a .gz suffix. Any name matches an empty list.
+func hasExtension(fn string, exts []string) bool {
+	if len(exts) == 0 {
+		return true
+	}
+	fn = strings.TrimSuffix(fn, ".gz")
+	for _, ext := range exts {
+		if strings.HasSuffix(fn, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// fileReadinStage reads the named files with n goroutines and sends their
+// lines on allLines, which is closed once they are all sent or ctx is
+// cancelled.
+func fileReadinStage(ctx context.Context, fnames chan string, n int, opts sorter.Options) (allLines chan readRow) {
+	lines := make([]chan readRow, n)
+	allLines = make(chan readRow)
 
 	// process files with n goroutines
 	for i := 0; i < n; i++ {
-		readFiles(fnames, lines[i])
+		lines[i] = make(chan readRow)
+		go func(ch chan readRow) {
+			readFiles(ctx, fnames, ch, opts)
+			close(ch)
+		}(lines[i])
 	}
 	wg := &sync.WaitGroup{}
 	for i := range lines {
 		wg.Add(1)
-		go func(ch chan []string) {
+		go func(ch chan readRow) {
+			defer wg.Done()
 			for line := range ch {
-				allLines <- line
+				select {
+				case allLines <- line:
+				case <-ctx.Done():
+					return
+				}
 			}
-			wg.Done()
 		}(lines[i])
 	}
 	go func() {
@@ -116,21 +897,124 @@ func fileReadinStage(fnames chan string, n int) (allLines chan []string) {
 	return allLines
 }
 
-func readFiles(fnames chan string, lines chan []string) {
-	lines = make(chan []string)
+// orderedReadinStage is fileReadinStage sending the lines file by file in
+// the order of fnames, while still reading n files at a time.
+func orderedReadinStage(ctx context.Context, fnames chan string, n int, opts sorter.Options) chan readRow {
+	type job struct {
+		fn   string
+		rows chan [][]string
+	}
+	jobs := make(chan job)
+	pending := make(chan chan [][]string, n) // results in file order
 	go func() {
+		defer close(jobs)
+		defer close(pending)
 		for fn := range fnames {
-			f, err := os.Open(fn)
-			if err != nil {
-				log.Fatal(err)
+			j := job{fn: fn, rows: make(chan [][]string, 1)}
+			select {
+			case pending <- j.rows:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case jobs <- j:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	for i := 0; i < n; i++ {
+		go func() {
+			for j := range jobs {
+				j.rows <- readFile(j.fn, opts)
+			}
+		}()
+	}
+
+	allLines := make(chan readRow)
+	go func() {
+		defer close(allLines)
+		for rows := range pending {
+			var content [][]string
+			select {
+			case content = <-rows:
+			case <-ctx.Done():
+				return
 			}
-			content := readContent(f)
 			for _, line := range content {
-				fmt.Println(line)
-				lines <- line
+				select {
+				case allLines <- readRow{row: line}:
+				case <-ctx.Done():
+					return
+				}
 			}
 		}
 	}()
+	return allLines
+}
+
+func readFiles(ctx context.Context, fnames chan string, lines chan readRow, opts sorter.Options) {
+	for fn := range fnames {
+		if ctx.Err() != nil {
+			return
+		}
+		if !sendFile(ctx, fn, lines, opts, func([]string) error { return nil }) {
+			return
+		}
+	}
+}
+
+// stringList is a flag.Value collecting comma-separated values from every
+// use of the flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, strings.Split(s, ",")...)
+	return nil
+}
+
+func listFlag(name string, usage string) *stringList {
+	l := &stringList{}
+	flag.Var(l, name, usage)
+	return l
+}
+
+// filterList is a flag.Value compiling a Filter from every use of the flag.
+type filterList []sorter.Filter
+
+func (l *filterList) String() string {
+	var s []string
+	for _, f := range *l {
+		s = append(s, fmt.Sprintf("%d=%s", f.Field, f.Pattern))
+	}
+	return strings.Join(s, " ")
+}
+
+func (l *filterList) Set(s string) error {
+	field, pattern, ok := strings.Cut(s, "=")
+	if !ok {
+		return fmt.Errorf("expected N=pattern, got %q", s)
+	}
+	n, err := strconv.Atoi(field)
+	if err != nil {
+		return fmt.Errorf("invalid field number %q", field)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, sorter.Filter{Field: n, Pattern: re})
+	return nil
+}
+
+func filterFlag(name string, usage string) *[]sorter.Filter {
+	l := &filterList{}
+	flag.Var(l, name, usage)
+	return (*[]sorter.Filter)(l)
 }
 
 func isFlagPassed(name string) bool {
@@ -143,133 +1027,491 @@ func isFlagPassed(name string) bool {
 	return found
 }
 
-func input() chan []string {
-	var readfrom *os.File
-	if isFlagPassed("i") {
-		f, err := os.Open(*inputFileName)
-		if err != nil {
-			log.Fatal(err)
-		}
-		readfrom = f
-	} else {
-		readfrom = os.Stdin
+// openInput opens the named file, decompressing it if the name ends in .gz.
+func openInput(fn string) (io.ReadCloser, error) {
+	f, err := openFile(fn)
+	if err != nil {
+		return nil, err
 	}
+	if !strings.HasSuffix(fn, ".gz") {
+		return &readCloser{Reader: stalled(f), Closer: f}, nil
+	}
+	gz, err := gzip.NewReader(stalled(f))
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	return &gzipFile{Reader: gz, f: f}, nil
+}
 
-	content := readContent(readfrom)
-	lines := make(chan []string)
+// openFile is os.Open failing after -timeout, for FIFOs that block until
+// something opens them for writing.
+func openFile(fn string) (*os.File, error) {
+	if *timeoutFlag <= 0 {
+		return os.Open(fn)
+	}
+	type result struct {
+		f   *os.File
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		f, err := os.Open(fn)
+		done <- result{f, err}
+	}()
+	select {
+	case r := <-done:
+		return r.f, r.err
+	case <-time.After(*timeoutFlag):
+		return nil, fmt.Errorf("open %s: nothing opened it for writing in %v", fn, *timeoutFlag)
+	}
+}
 
+// stalled returns r failing reads that wait longer than -timeout.
+func stalled(r io.Reader) io.Reader {
+	if *timeoutFlag <= 0 {
+		return r
+	}
+	return &timeoutReader{r: r, timeout: *timeoutFlag}
+}
+
+// timeoutReader fails a Read that returns nothing for the timeout, like one
+// from a pipe nothing writes to. The Read keeps waiting in the background,
+// so r can't be read again after that.
+type timeoutReader struct {
+	r       io.Reader
+	timeout time.Duration
+	buf     []byte
+}
+
+func (t *timeoutReader) Read(p []byte) (int, error) {
+	type result struct {
+		n   int
+		err error
+	}
+	// p may be reused once Read returns, the late read can't write into it
+	if len(t.buf) < len(p) {
+		t.buf = make([]byte, len(p))
+	}
+	buf := t.buf[:len(p)]
+	done := make(chan result, 1)
 	go func() {
-		for _, line := range content {
-			lines <- line
-		}
-		close(lines)
+		n, err := t.r.Read(buf)
+		done <- result{n, err}
 	}()
+	select {
+	case r := <-done:
+		return copy(p, buf[:r.n]), r.err
+	case <-time.After(t.timeout):
+		t.buf = nil
+		return 0, fmt.Errorf("nothing to read for %v", t.timeout)
+	}
+}
 
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// gzipFile closes both the decompressor and the file under it.
+type gzipFile struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (g *gzipFile) Close() error {
+	g.Reader.Close()
+	return g.f.Close()
+}
+
+// input reads the -i files, or stdin without them, and sends their lines
+// as they are read until they run out or ctx is cancelled. Every -i file
+// must have as many columns as the first one.
+func input(ctx context.Context, opts sorter.Options) chan readRow {
+	lines := make(chan readRow)
+	go func() {
+		defer close(lines)
+		if !isFlagPassed("i") {
+			sendFile(ctx, "-", lines, opts, func([]string) error { return nil })
+			return
+		}
+		first, columns := "", 0
+		for _, fn := range *inputFileNames {
+			if fn == "-" {
+				// with nothing piped in, reading would wait for typed input forever
+				if st, err := os.Stdin.Stat(); err == nil && st.Mode()&os.ModeCharDevice != 0 {
+					log.Fatal("ERROR: -i - reads stdin, but stdin is a terminal")
+				}
+			}
+			check := func(row []string) error {
+				if first == "" {
+					first, columns = fn, len(row)
+				} else if len(row) != columns && !opts.Ragged {
+					return fmt.Errorf("%s has %d columns, expected %d like in %s", fn, len(row), columns, first)
+				}
+				return nil
+			}
+			if !sendFile(ctx, fn, lines, opts, check) {
+				return
+			}
+		}
+	}()
 	return lines
 }
 
-func output(text [][]string) {
-	if isFlagPassed("o") {
-		f, err := os.Create(*outputFileName)
+// sendFile sends the rows of the named file, - stands for stdin, as they
+// are read. The first row goes to check, which can refuse the file. It
+// returns false if ctx is cancelled or the file fails, sending the error
+// after the rows read before it.
+func sendFile(ctx context.Context, fn string, lines chan<- readRow, opts sorter.Options, check func(first []string) error) bool {
+	send := func(r readRow) bool {
+		select {
+		case lines <- r:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	fail := func(err error) bool {
+		send(readRow{err: err})
+		return false
+	}
+	if *skipErrorsFlag || opts.Ragged || *checkFlag {
+		// a file failing halfway is skipped whole, or reported with -check,
+		// and ragged rows are padded to the longest, so the file is read
+		// first
+		rows := readFile(fn, opts)
+		if len(rows) > 0 {
+			if err := check(rows[0]); err != nil {
+				skipFile(fn, "ERROR: ", err)
+				return true
+			}
+		}
+		for _, row := range rows {
+			if !send(readRow{row: row}) {
+				return false
+			}
+		}
+		return true
+	}
+
+	rd, f, name, err := openRows(fn, opts)
+	if err != nil {
+		return fail(fmt.Errorf("Can't open input file: %w", err))
+	}
+	defer f.Close()
+	for first := true; ; first = false {
+		row, err := rd.Next()
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
-			log.Fatal(err)
+			return fail(fmt.Errorf("%s: %w", name, err))
+		}
+		if first {
+			if err := check(row); err != nil {
+				return fail(err)
+			}
+		}
+		if !send(readRow{row: row}) {
+			return false
+		}
+	}
+	filesRead.Add(1)
+	return true
+}
+
+// openRows opens the named file, - stands for stdin decompressed with -z,
+// for reading its rows one at a time. The name is the one to report
+// errors with.
+func openRows(fn string, opts sorter.Options) (rd *sorter.Reader, f io.Closer, name string, err error) {
+	name, f = fn, io.NopCloser(nil)
+	var in io.Reader
+	if fn == "-" {
+		name, in = "stdin", stalled(os.Stdin)
+		if *gzipFlag {
+			if in, err = gzip.NewReader(in); err != nil {
+				return nil, nil, name, fmt.Errorf("stdin: %v", err)
+			}
 		}
-		fmt.Fprintln(f, text)
-		fmt.Printf("Output is written to file %s\n", *outputFileName)
-		defer f.Close()
 	} else {
-		fmt.Printf("Result: %v\n", text)
+		rc, err := openInput(fn)
+		if err != nil {
+			return nil, nil, name, err
+		}
+		in, f = rc, rc
 	}
+	if reject := opts.Reject; reject != nil {
+		opts.Reject = func(row []string, err error) {
+			reject(row, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	rd, err = openReader(in, name, opts)
+	if err != nil {
+		f.Close()
+		return nil, nil, name, err
+	}
+	return rd, f, name, nil
 }
 
-func readContent(readfrom *os.File) (content [][]string) {
-	n := 0
-	s := bufio.NewScanner(readfrom)
+// merge returns the rows of the -d or -i files, or stdin without them,
+// merged in sorted order. The files are left open until the program exits.
+func merge(ctx context.Context, opts sorter.Options) sorter.RowReader {
+	names := []string{"-"}
+	if isFlagPassed("d") {
+		names = nil
+		for fn := range readDir(ctx, *dirs, *recursiveFlag, parseExtensions(*extFlag)) {
+			names = append(names, fn)
+		}
+	} else if isFlagPassed("i") {
+		names = *inputFileNames
+	}
+	var readers []*sorter.Reader
+	var opened []string
+	for _, fn := range names {
+		rd, _, name, err := openRows(fn, opts)
+		if err != nil {
+			skipFile(fn, "ERROR: Can't open input file: ", err)
+			continue
+		}
+		readers = append(readers, rd)
+		opened = append(opened, name)
+	}
+	if opts.Delimiter == sorter.AutoDelimiter && len(readers) > 0 {
+		opts.Delimiter = autoDelim
+	}
+	merged, err := sorter.MergeReaders(readers, opened, opts)
+	if err != nil {
+		log.Fatal("ERROR: ", err)
+	}
+	return merged
+}
 
-	if s.Err() != nil {
-		log.Fatal(s.Err())
+// readFile reads all the rows of the named file, - stands for stdin.
+func readFile(fn string, opts sorter.Options) [][]string {
+	rd, f, name, err := openRows(fn, opts)
+	if err != nil {
+		skipFile(fn, "ERROR: Can't open input file: ", err)
+		return nil
+	}
+	content, err := rd.ReadAll()
+	f.Close()
+	if err != nil {
+		skipFile(fn, "ERROR: "+name+": ", err)
+		return nil
 	}
+	filesRead.Add(1)
+	return content
+}
 
-	for s.Scan() {
-		line := s.Text()
-		row := strings.Split(line, ",")
-		if line == "" {
-			break
+// skipFile exits with the message and err, or with -skip-errors reports err
+// and counts fn as skipped. -check reports it with the other problems.
+func skipFile(fn, msg string, err error) {
+	if *checkFlag {
+		readProblems.add(strings.TrimPrefix(msg, "ERROR: ") + err.Error())
+		return
+	}
+	if !*skipErrorsFlag {
+		log.Fatal(msg, err)
+	}
+	fmt.Fprintf(os.Stderr, "WARNING: skipping %s: %v\n", fn, err)
+	skippedFiles.Add(1)
+}
+
+// openReader returns a reader for the rows of r. With -t auto the delimiter
+// is detected from the first input it's called for, later inputs get the
+// same delimiter.
+func openReader(r io.Reader, name string, opts sorter.Options) (rd *sorter.Reader, err error) {
+	if opts.Delimiter != sorter.AutoDelimiter {
+		return sorter.NewReader(r, opts)
+	}
+	detected := false
+	autoDelimOnce.Do(func() {
+		detected = true
+		if rd, err = sorter.NewReader(r, opts); err != nil {
+			autoDelim = ","
+			return
 		}
-		if n == 0 {
-			n = len(row)
+		var ok bool
+		if autoDelim, ok = rd.Delimiter(); !ok {
+			fmt.Fprintf(os.Stderr, "WARNING: %s: can't detect the delimiter, using a comma\n", name)
 		}
-		if n != len(row) {
-			log.Fatal("ERROR: The number of columns is not equal to the number of rows")
+	})
+	if detected {
+		return rd, err
+	}
+	opts.Delimiter = autoDelim
+	return sorter.NewReader(r, opts)
+}
+
+// readRow is a row sent by the reading stages, or the error that stopped
+// one. The error is sent in place of a row, so it comes after the rows read
+// before it: a row past -limit that fails is never received.
+type readRow struct {
+	row []string
+	err error
+}
+
+// receive returns the lines received from contentCh one at a time, exiting
+// on an error received in their place. If ctx is cancelled before the
+// channel is closed, only the lines received so far are returned.
+func receive(ctx context.Context, contentCh chan readRow) func() ([]string, bool) {
+	return func() ([]string, bool) {
+		select {
+		case line, ok := <-contentCh:
+			if line.err != nil {
+				log.Fatal("ERROR: ", line.err)
+			}
+			return line.row, ok
+		case <-ctx.Done():
+			return nil, false
 		}
-		content = append(content, row)
 	}
-	return content
 }
 
-func sortContent(contentCh chan []string, header bool, field int, reverse bool, sortAlgorithm int) {
-	buff := [][]string{}
+// output writes the rows to stdout or the -o file. It returns the errors
+// instead of exiting on them so the caller can close the rows first.
+func output(text sorter.RowReader, opts sorter.Options) error {
+	if opts.Delimiter == sorter.AutoDelimiter {
+		// a comma if there was no input to detect it from
+		autoDelimOnce.Do(func() { autoDelim = "," })
+		opts.Delimiter = autoDelim
+	}
+	if !isFlagPassed("o") {
+		sum, err := writeSum(os.Stdout, text, opts, *zOutFlag, nil)
+		if err != nil {
+			return err
+		}
+		return writeChecksum(sum, "-")
+	}
+	sum, err := writeFile(*outputFileName, text, opts)
+	if err != nil {
+		return err
+	}
+	if err := writeChecksum(sum, *outputFileName); err != nil {
+		return err
+	}
+	if *teeFlag {
+		// stdout has the sorted lines
+		fmt.Fprintf(os.Stderr, "Output is written to file %s\n", *outputFileName)
+	} else {
+		fmt.Printf("Output is written to file %s\n", *outputFileName)
+	}
+	return nil
+}
 
-	for line := range contentCh {
-		buff = append(buff, line)
+// writeFile writes the rows to the named file and returns the SHA-256 of
+// what it wrote. They go to a temporary file next to it first, renamed over
+// it once everything is written, so a failed sort leaves the file as it
+// was. Only -append and files that aren't regular, like /dev/stdout, are
+// written in place.
+func writeFile(name string, text sorter.RowReader, opts sorter.Options) (sum []byte, err error) {
+	st, serr := os.Lstat(name)
+	if *appendFlag || serr == nil && !st.Mode().IsRegular() {
+		return writeInPlace(name, text, opts)
+	}
+	perm := fs.FileMode(0644)
+	if serr == nil {
+		perm = st.Mode().Perm()
 	}
+	f, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".*")
+	if err != nil {
+		// the error names the temporary file pattern, not the output
+		var pe *fs.PathError
+		if errors.As(err, &pe) {
+			err = pe.Err
+		}
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	if err := f.Chmod(perm); err != nil {
+		return nil, err
+	}
+	if sum, err = writeSum(f, text, opts, strings.HasSuffix(name, ".gz"), teeOutput()); err != nil {
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	return sum, os.Rename(f.Name(), name)
+}
 
-	h := 0
-	if header {
-		h = 1
+// writeInPlace writes the rows to the named file itself, after what it has
+// with -append. The file is closed, and the error of closing it returned,
+// on every path.
+func writeInPlace(name string, text sorter.RowReader, opts sorter.Options) (sum []byte, err error) {
+	mode := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if *appendFlag {
+		mode = os.O_WRONLY | os.O_CREATE | os.O_APPEND
 	}
-	switch sortAlgorithm {
-	case 1:
-		sort.Slice(buff[h:], func(i, j int) bool {
-			if reverse {
-				return buff[i+h][field] > buff[j+h][field]
+	f, err := os.OpenFile(name, mode, 0666)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil && cerr != nil {
+			sum, err = nil, cerr
+		}
+	}()
+	if *appendFlag && opts.HeaderRows() > 0 && opts.Delimited() {
+		// the file already starts with the header unless it's empty
+		if st, err := f.Stat(); err == nil && st.Size() > 0 {
+			for i := 0; i < opts.HeaderRows(); i++ {
+				text.Read()
 			}
-			return buff[i+h][field] < buff[j+h][field]
-		})
-		sorted = buff
-	case 2:
-		// tree sort
-		t := &Tree{}
-		for i := h; i < len(buff); i++ {
-			t.insert(buff[i], field)
 		}
-		t.root.rewriteTree()
 	}
+	return writeSum(f, text, opts, strings.HasSuffix(name, ".gz"), teeOutput())
 }
 
-func (t *Tree) insert(data []string, field int) *Tree {
-	if t.root == nil {
-		t.root = &Node{data: data, left: nil, right: nil}
-	} else {
-		t.root.insert(data, field)
+// teeOutput is where -tee copies the output to, nil without it.
+func teeOutput() io.Writer {
+	if *teeFlag {
+		return os.Stdout
 	}
-	return t
+	return nil
 }
 
-func (n *Node) insert(data []string, field int) {
-	if n == nil {
-		return
-	} else if data[field] <= n.data[field] {
-		if n.left == nil {
-			n.left = &Node{data: data, left: nil, right: nil}
-		} else {
-			n.left.insert(data, field)
-		}
-	} else {
-		if n.right == nil {
-			n.right = &Node{data: data, left: nil, right: nil}
-		} else {
-			n.right.insert(data, field)
+// writeSum writes the rows to w, compressed with gzip if compress is set,
+// and returns the SHA-256 of the bytes w got. A tee gets the rows
+// uncompressed. Everything buffered is flushed before it returns.
+func writeSum(w io.Writer, text sorter.RowReader, opts sorter.Options, compress bool, tee io.Writer) ([]byte, error) {
+	h := sha256.New()
+	w = io.MultiWriter(w, h)
+	var gz *gzip.Writer
+	if compress {
+		gz = gzip.NewWriter(w)
+		w = gz
+	}
+	if tee != nil {
+		w = io.MultiWriter(w, tee)
+	}
+	// sorter.WriteRows flushes its bufio.Writer
+	if err := sorter.WriteRows(w, text, opts); err != nil {
+		return nil, err
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return nil, err
 		}
 	}
+	return h.Sum(nil), nil
 }
 
-func (node *Node) rewriteTree() {
-	if node.left != nil {
-		node.left.rewriteTree()
+// writeChecksum prints the sum of the output with -checksum and writes it
+// to the .sha256 file with -checksum-file, both in the sha256sum format.
+func writeChecksum(sum []byte, name string) error {
+	line := fmt.Sprintf("%s  %s\n", hex.EncodeToString(sum), filepath.Base(name))
+	if *checksumFlag {
+		fmt.Fprint(os.Stderr, line)
 	}
-	sorted = append(sorted, node.data)
-	if node.right != nil {
-		node.right.rewriteTree()
+	if *sidecarFlag {
+		return os.WriteFile(name+".sha256", []byte(line), 0666)
 	}
+	return nil
 }
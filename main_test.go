@@ -0,0 +1,1646 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/XsiaX/Golang-2/sorter"
+)
+
+// TestMain runs the command instead of the tests when run starts the test
+// binary again as the command.
+func TestMain(m *testing.M) {
+	if os.Getenv("CSORT_TEST_MAIN") == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// result is what a run of the command printed and its exit code.
+type result struct {
+	stdout, stderr string
+	code           int
+}
+
+// run runs the command in dir, the current directory if empty, with the
+// args and stdin.
+func run(t *testing.T, dir, stdin string, args ...string) result {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "CSORT_TEST_MAIN=1")
+	cmd.Stdin = strings.NewReader(stdin)
+	var stdout, stderr strings.Builder
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	r := result{}
+	var ee *exec.ExitError
+	if err := cmd.Run(); errors.As(err, &ee) {
+		r.code = ee.ExitCode()
+	} else if err != nil {
+		t.Fatalf("running %v: %v", args, err)
+	}
+	r.stdout, r.stderr = stdout.String(), stderr.String()
+	return r
+}
+
+// writeFiles creates the files, by their names relative to dir, with the
+// directories they are in.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		fn := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fn, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTreeSortFlag(t *testing.T) {
+	tests := []struct {
+		name, in string
+		args     []string
+	}{
+		{"three rows", "b,2\nc,3\na,1\n", nil},
+		{"one row", "a,1\n", nil},
+		{"empty", "", nil},
+		{"second field", "b,3\na,2\nc,1\n", []string{"-f", "1"}},
+		{"reversed", "b,2\nc,3\na,1\n", []string{"-r"}},
+		{"reversed by the second field", "b,3\na,2\nc,1\n", []string{"-r", "-f", "1"}},
+		{"reversed one row", "a,1\n", []string{"-r"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			builtin := run(t, "", tt.in, append([]string{"-a", "1"}, tt.args...)...)
+			tree := run(t, "", tt.in, append([]string{"-a", "2"}, tt.args...)...)
+			if tree.code != 0 || tree.stdout != builtin.stdout {
+				t.Errorf("tree sort = %q, exit code %d, stderr %q; built in sort = %q", tree.stdout, tree.code, tree.stderr, builtin.stdout)
+			}
+		})
+	}
+}
+
+func TestOutputLines(t *testing.T) {
+	tests := []struct {
+		name, in string
+		args     []string
+		want     string
+	}{
+		{"rows", "b,2\na,1\n", nil, "a,1\nb,2\n"},
+		{"one field", "b\na\n", nil, "a\nb\n"},
+		{"tree sort", "b,2\na,1\n", []string{"-a", "2"}, "a,1\nb,2\n"},
+		{"empty", "", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := run(t, "", tt.in, tt.args...)
+			if r.code != 0 || r.stdout != tt.want {
+				t.Errorf("output = %q, exit code %d, stderr %q; want %q", r.stdout, r.code, r.stderr, tt.want)
+			}
+		})
+	}
+}
+
+func TestOutputFileReadsBack(t *testing.T) {
+	dir := t.TempDir()
+	const in = "c,3\na,1\nb,2\n"
+	if r := run(t, dir, in, "-o", "out.csv"); r.code != 0 {
+		t.Fatalf("exit code %d, stderr %q", r.code, r.stderr)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "out.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "a,1\nb,2\nc,3\n" {
+		t.Errorf("out.csv = %q", b)
+	}
+	// sorting the output again in reverse reads every row back
+	r := run(t, dir, "", "-i", "out.csv", "-r")
+	if r.code != 0 || r.stdout != "c,3\nb,2\na,1\n" {
+		t.Errorf("output = %q, exit code %d, stderr %q", r.stdout, r.code, r.stderr)
+	}
+}
+
+func TestDelimiterFlag(t *testing.T) {
+	tests := []struct {
+		name, in string
+		args     []string
+		want     string
+	}{
+		{"comma by default", "b,1\na,2\n", nil, "a,2\nb,1\n"},
+		{"tab", "b\t1\na\t2\n", []string{"-t", `\t`, "-f", "1"}, "b\t1\na\t2\n"},
+		{"several characters", "b::1\na::2\n", []string{"-t", "::"}, "a::2\nb::1\n"},
+		{"one column", "b\na\n", []string{"-t", ";"}, "a\nb\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := run(t, "", tt.in, tt.args...)
+			if r.code != 0 || r.stdout != tt.want {
+				t.Errorf("output = %q, exit code %d, stderr %q; want %q", r.stdout, r.code, r.stderr, tt.want)
+			}
+		})
+	}
+}
+
+func TestDirectory(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		args  []string
+		want  string
+	}{
+		{
+			"two files",
+			map[string]string{"a.csv": "d,4\nb,2\n", "b.csv": "c,3\na,1\n"},
+			nil,
+			"a,1\nb,2\nc,3\nd,4\n",
+		},
+		{
+			"with workers",
+			map[string]string{"a.csv": "d,4\nb,2\n", "b.csv": "c,3\na,1\n", "c.csv": "e,5\n"},
+			[]string{"-w", "2"},
+			"a,1\nb,2\nc,3\nd,4\ne,5\n",
+		},
+		{
+			"empty directory",
+			map[string]string{},
+			nil,
+			"",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFiles(t, dir, tt.files)
+			r := run(t, "", "", append([]string{"-d", dir}, tt.args...)...)
+			if r.code != 0 || r.stdout != tt.want {
+				t.Errorf("output = %q, exit code %d, stderr %q; want %q", r.stdout, r.code, r.stderr, tt.want)
+			}
+		})
+	}
+}
+
+func TestDirectoryPaths(t *testing.T) {
+	tests := []struct {
+		name     string
+		setup    func(t *testing.T, dir string)
+		want     string
+		code     int
+		inStderr string
+	}{
+		{
+			"subdirectory skipped",
+			func(t *testing.T, dir string) {
+				writeFiles(t, dir, map[string]string{"a.csv": "b\na\n", "sub/c.csv": "c\n"})
+			},
+			"a\nb\n", 0, "",
+		},
+		{
+			"failing file named",
+			func(t *testing.T, dir string) {
+				writeFiles(t, dir, map[string]string{"a.csv": "a\n"})
+				if err := os.Symlink(filepath.Join(dir, "missing"), filepath.Join(dir, "broken.csv")); err != nil {
+					t.Skip("can't make a symbolic link:", err)
+				}
+			},
+			"", 1, "broken.csv",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			tt.setup(t, dir)
+			// run somewhere else, so the file names must be joined with dir
+			r := run(t, t.TempDir(), "", "-d", dir)
+			if r.code != tt.code || r.stdout != tt.want || !strings.Contains(r.stderr, tt.inStderr) {
+				t.Errorf("output = %q, exit code %d, stderr %q; want %q, exit code %d, stderr with %q",
+					r.stdout, r.code, r.stderr, tt.want, tt.code, tt.inStderr)
+			}
+		})
+	}
+}
+
+func TestDirectoryStdoutOnlySorted(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"a.csv": "c,3\na,1\n", "b.csv": "b,2\n"})
+	out := filepath.Join(t.TempDir(), "out.csv")
+	tests := []struct {
+		name   string
+		args   []string
+		stdout string
+	}{
+		{"to stdout", []string{"-d", dir}, "a,1\nb,2\nc,3\n"},
+		{"to a file", []string{"-d", dir, "-o", out}, "Output is written to file " + out + "\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if r := run(t, "", "", tt.args...); r.code != 0 || r.stdout != tt.stdout {
+				t.Errorf("stdout = %q, exit code %d, stderr %q; want %q", r.stdout, r.code, r.stderr, tt.stdout)
+			}
+		})
+	}
+	if b, err := os.ReadFile(out); err != nil || string(b) != "a,1\nb,2\nc,3\n" {
+		t.Errorf("-o file = %q, %v", b, err)
+	}
+}
+
+// gzipped returns s compressed with gzip.
+func gzipped(t *testing.T, s string) string {
+	t.Helper()
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	if _, err := zw.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+func TestGzipInput(t *testing.T) {
+	dir := t.TempDir()
+	gz := gzipped(t, "c\na\nb\n")
+	writeFiles(t, dir, map[string]string{
+		"in.csv.gz":  gz,
+		"bad.csv.gz": "this is not gzip at all\n",
+		"cut.csv.gz": gz[:len(gz)-6],
+	})
+	tests := []struct {
+		name, stdin string
+		args        []string
+		want        string
+		code        int
+		inStderr    string
+	}{
+		{"file", "", []string{"-i", filepath.Join(dir, "in.csv.gz")}, "a\nb\nc\n", 0, ""},
+		{"directory", "", []string{"-d", dir, "-skip-errors"}, "a\nb\nc\n", 1, "input files skipped: 2"},
+		{"stdin", gz, []string{"-z"}, "a\nb\nc\n", 0, ""},
+		{"not gzip", "", []string{"-i", filepath.Join(dir, "bad.csv.gz")}, "", 1, "bad.csv.gz: gzip: invalid header"},
+		{"truncated", "", []string{"-i", filepath.Join(dir, "cut.csv.gz")}, "", 1, "unexpected EOF"},
+		{"stdin not gzip", "this is not gzip at all\n", []string{"-z"}, "", 1, "stdin: gzip: invalid header"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := run(t, "", tt.stdin, tt.args...)
+			if r.stdout != tt.want || r.code != tt.code || !strings.Contains(r.stderr, tt.inStderr) {
+				t.Errorf("output = %q, exit code %d, stderr %q; want %q, exit code %d, stderr with %q",
+					r.stdout, r.code, r.stderr, tt.want, tt.code, tt.inStderr)
+			}
+		})
+	}
+}
+
+// expect checks the run printed want to stdout, something with inStderr to
+// stderr and exited with code.
+func (r result) expect(t *testing.T, want string, code int, inStderr string) {
+	t.Helper()
+	if r.stdout != want || r.code != code || !strings.Contains(r.stderr, inStderr) {
+		t.Errorf("output = %q, exit code %d, stderr %q; want %q, exit code %d, stderr with %q",
+			r.stdout, r.code, r.stderr, want, code, inStderr)
+	}
+}
+
+func TestRecursiveDirectory(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a.csv":          "c\n",
+		"sub/b.csv":      "a\n",
+		"sub/deep/c.csv": "b\n",
+		"sub/notes.txt":  "not read\n",
+	})
+	// a loop back up the tree isn't followed
+	if err := os.Symlink(dir, filepath.Join(dir, "sub", "loop")); err != nil {
+		t.Skip("can't make a symbolic link:", err)
+	}
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"recursive", []string{"-R"}, "a\nb\nc\n"},
+		{"top level only", nil, "c\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			run(t, "", "", append([]string{"-d", dir}, tt.args...)...).expect(t, tt.want, 0, "")
+		})
+	}
+}
+
+func TestExtensionFilter(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a.csv":  "b\n",
+		"b.tsv":  "a\n",
+		"c.txt":  "not,\"csv\n",
+		"d.json": "{\"not\": \"csv\"}\n",
+	})
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"csv by default", nil, "b\n"},
+		{"other extension", []string{"-ext", ".tsv"}, "a\n"},
+		{"list", []string{"-ext", ".csv, .tsv"}, "a\nb\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			run(t, "", "", append([]string{"-d", dir}, tt.args...)...).expect(t, tt.want, 0, "")
+		})
+	}
+}
+
+func TestWorkers(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{}
+	var want []string
+	for i := 0; i < 20; i++ {
+		files[fmt.Sprintf("%02d.csv", i)] = fmt.Sprintf("%02d,a\n%02d,b\n", i, i)
+		want = append(want, fmt.Sprintf("%02d,a\n%02d,b\n", i, i))
+	}
+	writeFiles(t, dir, files)
+	tests := []struct {
+		workers  string
+		want     string
+		code     int
+		inStderr string
+	}{
+		{"1", strings.Join(want, ""), 0, ""},
+		{"8", strings.Join(want, ""), 0, ""},
+		{"0", "", 1, "The number of workers must be at least 1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.workers, func(t *testing.T) {
+			run(t, "", "", "-d", dir, "-w", tt.workers, "-f", "0,1").expect(t, tt.want, tt.code, tt.inStderr)
+		})
+	}
+}
+
+func TestVersion(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"alone", []string{"-version"}},
+		// the input isn't opened
+		{"before other flags", []string{"-version", "-i", "missing.csv"}},
+		{"after other flags", []string{"-i", "missing.csv", "-version"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := run(t, t.TempDir(), "", tt.args...)
+			if r.code != 0 || !strings.HasPrefix(r.stdout, "version ") || r.stderr != "" {
+				t.Errorf("output = %q, exit code %d, stderr %q; want a version", r.stdout, r.code, r.stderr)
+			}
+		})
+	}
+}
+
+func TestUsage(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		code int
+	}{
+		{"help", []string{"-help"}, 0},
+		{"unknown flag", []string{"-bogus"}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := run(t, "", "", tt.args...)
+			if r.code != tt.code {
+				t.Errorf("exit code %d, want %d", r.code, tt.code)
+			}
+			for _, want := range []string{"Sorts lines of delimited files", "Algorithms (-a): builtin", "tree", "merge", "Examples:"} {
+				if !strings.Contains(r.stderr, want) {
+					t.Errorf("usage %q doesn't have %q", r.stderr, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSeveralInputFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a.csv": "c,3\na,1\n",
+		"b.csv": "b,2\n",
+		"c.csv": "d,4,x\n",
+	})
+	tests := []struct {
+		name     string
+		args     []string
+		want     string
+		code     int
+		inStderr string
+	}{
+		{"repeated", []string{"-i", "a.csv", "-i", "b.csv"}, "a,1\nb,2\nc,3\n", 0, ""},
+		{"comma list", []string{"-i", "a.csv,b.csv"}, "a,1\nb,2\nc,3\n", 0, ""},
+		{"other columns", []string{"-i", "a.csv,c.csv"}, "", 1, "c.csv has 3 columns, expected 2 like in a.csv"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			run(t, dir, "", tt.args...).expect(t, tt.want, tt.code, tt.inStderr)
+		})
+	}
+}
+
+func TestStdinWithFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"a.csv": "c\na\n"})
+	tests := []struct {
+		name, stdin string
+		args        []string
+		want        string
+	}{
+		{"file and stdin", "b\n", []string{"-i", "a.csv", "-i", "-"}, "a\nb\nc\n"},
+		{"stdin first", "b\n", []string{"-i", "-,a.csv"}, "a\nb\nc\n"},
+		{"without -", "b\n", []string{"-i", "a.csv"}, "a\nc\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			run(t, dir, tt.stdin, tt.args...).expect(t, tt.want, 0, "")
+		})
+	}
+}
+
+func TestColumnCountErrorNamesFile(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"data.csv": "a,b,c\nd,e,f\ng,h,i,j\n"})
+	run(t, dir, "", "-i", "data.csv").expect(t, "", 1, "ERROR: data.csv: line 3 has 4 columns, expected 3")
+	run(t, dir, "a,b\nc\n").expect(t, "", 1, "ERROR: stdin: line 2 has 1 columns, expected 2")
+}
+
+func TestAppend(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing *string
+		args     []string
+		want     string
+	}{
+		{"two runs", nil, []string{"-append"}, "a,1\nb,2\nc,3\nd,4\n"},
+		{"two runs with a header", nil, []string{"-append", "-h"}, "k,v\na,1\nb,2\nc,3\nd,4\n"},
+		{"empty file with a header", new(string), []string{"-append", "-h"}, "k,v\na,1\nb,2\nc,3\nd,4\n"},
+		{"overwrite", nil, nil, "c,3\nd,4\n"},
+		{"overwrite with a header", nil, []string{"-h"}, "k,v\nc,3\nd,4\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if tt.existing != nil {
+				writeFiles(t, dir, map[string]string{"out.csv": *tt.existing})
+			}
+			header := ""
+			for _, a := range tt.args {
+				if a == "-h" {
+					header = "k,v\n"
+				}
+			}
+			args := append([]string{"-o", "out.csv"}, tt.args...)
+			for _, in := range []string{"b,2\na,1\n", "d,4\nc,3\n"} {
+				if r := run(t, dir, header+in, args...); r.code != 0 {
+					t.Fatalf("exit code %d, stderr %q", r.code, r.stderr)
+				}
+			}
+			got, err := os.ReadFile(filepath.Join(dir, "out.csv"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("out.csv = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name, in string
+		args     []string
+		want     string
+		code     int
+		inStderr []string
+	}{
+		{"valid", "a,1\nb,2\n", nil, "2 rows, 2 columns, 0 problems\n", 0, nil},
+		{"malformed", "a,1\nb,2,3\nc,x\n", []string{"-n", "-f", "1"}, "1 rows, 2 columns, 2 problems\n", 1, []string{
+			"ERROR: stdin: line 2 has 3 columns, expected 2",
+			`ERROR: stdin: line 3: field 1 is not a number: "x"`,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := run(t, "", tt.in, append([]string{"-check"}, tt.args...)...)
+			r.expect(t, tt.want, tt.code, "")
+			for _, s := range tt.inStderr {
+				if !strings.Contains(r.stderr, s) {
+					t.Errorf("stderr %q, want it with %q", r.stderr, s)
+				}
+			}
+		})
+	}
+}
+
+func TestGrepFlag(t *testing.T) {
+	tests := []struct {
+		value string
+		err   string
+	}{
+		{"2=^A", ""},
+		{"0=", ""},
+		{"2", `expected N=pattern, got "2"`},
+		{"x=a", `invalid field number "x"`},
+		{"1=[", "error parsing regexp: missing closing ]: `[`"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			var l filterList
+			err := l.Set(tt.value)
+			if tt.err == "" {
+				if err != nil || len(l) != 1 || l.String() != tt.value {
+					t.Errorf("Set(%q) = %v, list %q", tt.value, err, l.String())
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("Set(%q) error = %v, want %q", tt.value, err, tt.err)
+			}
+		})
+	}
+	run(t, "", "Bob,Austin\nAnn,Boston\nAl,Atlanta\n", "-grep", "1=^A", "-grep", "0=^B").expect(t, "Bob,Austin\n", 0, "")
+	run(t, "", "", "-grep", "1=[").expect(t, "", 2, "missing closing ]")
+}
+
+func TestAutoDelimiterWarning(t *testing.T) {
+	run(t, "", "b;2\na;1\n", "-t", "auto").expect(t, "a;1\nb;2\n", 0, "")
+	run(t, "", "a,b;c\nd,e;f\n", "-t", "auto").expect(t, "a,b;c\nd,e;f\n", 0, "WARNING: stdin: can't detect the delimiter, using a comma")
+}
+
+func TestQuoteFlag(t *testing.T) {
+	run(t, "", "'b,x',c\n'a,y',d\n", "-quote", "'", "-cols", "1").expect(t, "d\nc\n", 0, "")
+	run(t, "", "x\n", "-quote", "ab").expect(t, "", 1, "The quote must be a single character")
+}
+
+func TestBench(t *testing.T) {
+	dir := t.TempDir()
+	r := run(t, dir, "b,2\na,1\nc,3\n", "-bench", "-o", "out.csv")
+	if r.code != 0 {
+		t.Fatalf("exit code %d, stderr %q", r.code, r.stderr)
+	}
+	lines := strings.Split(strings.TrimSuffix(r.stdout, "\n"), "\n")
+	if len(lines) == 0 || !strings.HasPrefix(lines[0], "ALGORITHM") {
+		t.Fatalf("output %q has no header", r.stdout)
+	}
+	algorithms := sorter.Algorithms()
+	if len(lines)-1 != len(algorithms) {
+		t.Errorf("output %q has %d algorithms, want %d", r.stdout, len(lines)-1, len(algorithms))
+	}
+	for i, name := range algorithms {
+		if i+1 >= len(lines) {
+			break
+		}
+		fields := strings.Fields(lines[i+1])
+		if len(fields) != 3 || fields[0] != name || fields[2] != "same" {
+			t.Errorf("line %q, want %s with the same output", lines[i+1], name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "out.csv")); !os.IsNotExist(err) {
+		t.Errorf("-bench wrote the -o file: %v", err)
+	}
+}
+
+func TestAlgorithmFlag(t *testing.T) {
+	tests := []struct {
+		args     []string
+		want     string
+		code     int
+		inStderr string
+	}{
+		{[]string{"-a", "tree"}, "a\nb\n", 0, ""},
+		{[]string{"-a", "merge", "-chunk", "1"}, "a\nb\n", 0, ""},
+		{[]string{"-a", "1"}, "a\nb\n", 0, "WARNING: -a 1 is deprecated, use -a builtin"},
+		{[]string{"-a", "2"}, "a\nb\n", 0, "WARNING: -a 2 is deprecated, use -a tree"},
+		{[]string{"-a", "3"}, "a\nb\n", 0, "WARNING: -a 3 is deprecated, use -a merge"},
+		{[]string{"-a", "bubble"}, "", 1, `ERROR: unknown sorting algorithm "bubble", valid ones are builtin, merge, tree`},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.args, " "), func(t *testing.T) {
+			run(t, "", "b\na\n", tt.args...).expect(t, tt.want, tt.code, tt.inStderr)
+		})
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	tests := []struct {
+		s      string
+		fields []int
+		orders []sorter.Order
+		err    string
+	}{
+		{"0", []int{0}, []sorter.Order{sorter.Ascending}, ""},
+		{"0:asc,2:desc", []int{0, 2}, []sorter.Order{sorter.Ascending, sorter.Descending}, ""},
+		{"1:desc, -1", []int{1, -1}, []sorter.Order{sorter.Descending, sorter.Ascending}, ""},
+		{"0:down", nil, nil, `ERROR: Invalid sort order "down", expected asc or desc`},
+		{"x:desc", nil, nil, `ERROR: Invalid field number "x"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			fields, orders, err := parseKeys(tt.s)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Errorf("parseKeys error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(fields, tt.fields) || !reflect.DeepEqual(orders, tt.orders) {
+				t.Errorf("parseKeys = %v, %v, %v; want %v, %v", fields, orders, err, tt.fields, tt.orders)
+			}
+		})
+	}
+}
+
+func TestStatsFlag(t *testing.T) {
+	r := run(t, "", "k,v\nb,2\na,1\nb,2\n", "-stats", "-h", "-u", "-f", "1")
+	r.expect(t, "k,v\na,1\nb,2\n", 0, "rows: 3\ncolumns: 2\nduplicates: 1\nmin: 1\nmax: 2\nelapsed: ")
+}
+
+func TestTee(t *testing.T) {
+	tests := []struct {
+		name, in string
+		args     []string
+		want     string
+	}{
+		{"csv", "b,2\na,1\n", nil, "a,1\nb,2\n"},
+		{"header", "k,v\nb,2\na,1\n", []string{"-h"}, "k,v\na,1\nb,2\n"},
+		{"json", "b,2\n", []string{"-format", "json"}, "[\n  [\n    \"b\",\n    \"2\"\n  ]\n]\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			r := run(t, dir, tt.in, append([]string{"-tee", "-o", "out.csv"}, tt.args...)...)
+			r.expect(t, tt.want, 0, "")
+			got, err := os.ReadFile(filepath.Join(dir, "out.csv"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != r.stdout {
+				t.Errorf("out.csv = %q, stdout %q", got, r.stdout)
+			}
+		})
+	}
+}
+
+// manyFiles writes n files of 100 lines each to a new directory.
+func manyFiles(t *testing.T, n int) string {
+	t.Helper()
+	dir := t.TempDir()
+	files := map[string]string{}
+	for i := 0; i < n; i++ {
+		files[fmt.Sprintf("%02d.csv", i)] = strings.Repeat(fmt.Sprintf("%d,x\n", i), 100)
+	}
+	writeFiles(t, dir, files)
+	return dir
+}
+
+// drained reads ch until it is closed and reports false if that takes
+// longer than timeout.
+func drained[T any](ch chan T, timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				return true
+			}
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+type readinStage func(ctx context.Context, fnames chan string, n int, opts sorter.Options) chan readRow
+
+var readinStages = []struct {
+	name  string
+	stage readinStage
+}{
+	{"unordered", func(ctx context.Context, fnames chan string, n int, opts sorter.Options) chan readRow {
+		return fileReadinStage(ctx, fnames, n, opts)
+	}},
+	{"ordered", orderedReadinStage},
+}
+
+func TestReadinStageCancel(t *testing.T) {
+	dir := manyFiles(t, 20)
+	for _, tt := range readinStages {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			fnames := readDir(ctx, []string{dir}, false, []string{".csv"})
+			lines := tt.stage(ctx, fnames, 3, sorter.Options{})
+			if _, ok := <-lines; !ok {
+				t.Fatal("no lines read")
+			}
+			cancel()
+			if !drained(lines, 2*time.Second) {
+				t.Error("the lines aren't closed after cancelling")
+			}
+			if !drained(fnames, 2*time.Second) {
+				t.Error("the file names aren't closed after cancelling")
+			}
+		})
+	}
+}
+
+func TestReadDirCancel(t *testing.T) {
+	dir := manyFiles(t, 5)
+	ctx, cancel := context.WithCancel(context.Background())
+	fnames := readDir(ctx, []string{dir}, false, []string{".csv"})
+	<-fnames
+	cancel()
+	// the sender stops without anyone reading the other names
+	time.Sleep(10 * time.Millisecond)
+	if !drained(fnames, 2*time.Second) {
+		t.Error("the file names aren't closed after cancelling")
+	}
+}
+
+func TestReadDirs(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"one/x.csv":   "c\na\n",
+		"one/y.txt":   "z\n",
+		"two/x.csv":   "b\n",
+		"two/y.csv":   "d\n",
+		"three/x.csv": "e\n",
+	})
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"comma-separated", []string{"-d", "one,two"}, "a\nb\nc\nd\n"},
+		{"repeated", []string{"-d", "one", "-d", "two"}, "a\nb\nc\nd\n"},
+		{"three", []string{"-d", "one,two", "-d", "three"}, "a\nb\nc\nd\ne\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			run(t, dir, "", tt.args...).expect(t, tt.want, 0, "")
+		})
+	}
+
+	var got []string
+	for fn := range readDir(context.Background(), []string{filepath.Join(dir, "one"), filepath.Join(dir, "two")}, false, []string{".csv"}) {
+		got = append(got, fn)
+	}
+	want := []string{filepath.Join(dir, "one", "x.csv"), filepath.Join(dir, "two", "x.csv"), filepath.Join(dir, "two", "y.csv")}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("readDir sent %q, want %q", got, want)
+	}
+}
+
+// goroutinesBackTo waits for the number of goroutines to drop to n and
+// reports whether it did within a second.
+func goroutinesBackTo(n int) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if runtime.NumGoroutine() <= n {
+			return true
+		}
+	}
+	return false
+}
+
+func TestReadinStageNoLeaks(t *testing.T) {
+	dir := manyFiles(t, 10)
+	for _, tt := range readinStages {
+		for _, cancelEarly := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s cancelled %v", tt.name, cancelEarly), func(t *testing.T) {
+				before := runtime.NumGoroutine()
+				ctx, cancel := context.WithCancel(context.Background())
+				lines := tt.stage(ctx, readDir(ctx, []string{dir}, false, []string{".csv"}), 4, sorter.Options{})
+				n := 0
+				for range lines {
+					if n++; n == 50 && cancelEarly {
+						cancel()
+					}
+				}
+				cancel()
+				if !cancelEarly && n != 1000 {
+					t.Errorf("read %d lines, want 1000", n)
+				}
+				if !goroutinesBackTo(before) {
+					t.Errorf("%d goroutines left running, %d before", runtime.NumGoroutine(), before)
+				}
+			})
+		}
+	}
+}
+
+func TestDeterministic(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{}
+	var want strings.Builder
+	for i := 0; i < 8; i++ {
+		var b strings.Builder
+		for j := 0; j < 50; j++ {
+			// every line has the same key
+			fmt.Fprintf(&b, "k,%d-%d\n", i, j)
+			fmt.Fprintf(&want, "k,%d-%d\n", i, j)
+		}
+		files[fmt.Sprintf("%d.csv", i)] = b.String()
+	}
+	writeFiles(t, dir, files)
+	for i := 0; i < 5; i++ {
+		r := run(t, "", "", "-d", dir, "-deterministic", "-stable", "-w", "4")
+		r.expect(t, want.String(), 0, "")
+		if t.Failed() {
+			t.Fatalf("run %d isn't in file then line order", i+1)
+		}
+	}
+}
+
+func TestSkipErrors(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a.csv": "b,2\n",
+		"c.csv": "a,1\n",
+		"d.csv": "x\ny,1\n",
+	})
+	// a link to nothing can't be opened, even by root
+	if err := os.Symlink(filepath.Join(dir, "missing"), filepath.Join(dir, "b.csv")); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		args     []string
+		want     string
+		inStderr []string
+	}{
+		{"skipped", []string{"-skip-errors"}, "a,1\nb,2\n", []string{
+			"WARNING: skipping " + filepath.Join(dir, "b.csv") + ": open ",
+			"WARNING: skipping " + filepath.Join(dir, "d.csv") + ": line 2 has 2 columns, expected 1",
+			"ERROR: input files skipped: 2",
+		}},
+		{"skipped with workers", []string{"-skip-errors", "-w", "1"}, "a,1\nb,2\n", []string{"ERROR: input files skipped: 2"}},
+		{"fatal", []string{"-w", "1"}, "", []string{"ERROR: Can't open input file: open " + filepath.Join(dir, "b.csv")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := run(t, "", "", append([]string{"-d", dir}, tt.args...)...)
+			r.expect(t, tt.want, 1, "")
+			for _, s := range tt.inStderr {
+				if !strings.Contains(r.stderr, s) {
+					t.Errorf("stderr %q, want it with %q", r.stderr, s)
+				}
+			}
+		})
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	const in = "b,2\na,1\nc,3\n"
+	sum := fmt.Sprintf("%x", sha256.Sum256([]byte("a,1\nb,2\nc,3\n")))
+	tests := []struct {
+		name   string
+		args   []string
+		stdout string
+		sum    string // the line on stderr
+	}{
+		{"stdout", []string{"-checksum"}, "a,1\nb,2\nc,3\n", sum + "  -\n"},
+		{"file", []string{"-checksum", "-o", "out.csv"}, "Output is written to file out.csv\n", sum + "  out.csv\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sums []string
+			for i := 0; i < 2; i++ {
+				r := run(t, t.TempDir(), in, tt.args...)
+				r.expect(t, tt.stdout, 0, tt.sum)
+				sums = append(sums, r.stderr)
+			}
+			if sums[0] != sums[1] {
+				t.Errorf("two runs printed %q and %q", sums[0], sums[1])
+			}
+		})
+	}
+	dir := t.TempDir()
+	run(t, dir, in, "-o", "out.csv", "-checksum-file").expect(t, "Output is written to file out.csv\n", 0, "")
+	if got, err := os.ReadFile(filepath.Join(dir, "out.csv.sha256")); err != nil || string(got) != sum+"  out.csv\n" {
+		t.Errorf("out.csv.sha256 = %q, %v; want %q", got, err, sum+"  out.csv\n")
+	}
+}
+
+func TestMergeFlag(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"1.csv":   "a,1\nd,4\n",
+		"2.csv":   "b,2\ne,5\n",
+		"3.csv":   "c,3\nf,6\n",
+		"bad.csv": "z,1\ny,2\n",
+	})
+	run(t, dir, "", "-merge", "-i", "1.csv,2.csv,3.csv").expect(t, "a,1\nb,2\nc,3\nd,4\ne,5\nf,6\n", 0, "")
+	run(t, dir, "", "-merge", "-i", "1.csv", "-i", "bad.csv").expect(t, "", 1, "bad.csv: line 2 is out of order, the input isn't sorted")
+}
+
+func TestProgress(t *testing.T) {
+	dir := manyFiles(t, 7)
+	tests := []struct {
+		name   string
+		args   []string
+		stdout string
+	}{
+		{"stdout", nil, ""},
+		{"file", []string{"-o", "out.csv"}, "Output is written to file out.csv\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := run(t, t.TempDir(), "", append([]string{"-d", dir, "-progress"}, tt.args...)...)
+			if r.code != 0 {
+				t.Fatalf("exit code %d, stderr %q", r.code, r.stderr)
+			}
+			if !strings.HasSuffix(r.stderr, "read: 7 files, 700 lines\n") {
+				t.Errorf("stderr %q, want it to end with the final count", r.stderr)
+			}
+			if tt.stdout == "" {
+				if n := strings.Count(r.stdout, "\n"); n != 700 || strings.Contains(r.stdout, "files") {
+					t.Errorf("stdout has %d lines, want only the 700 sorted ones", n)
+				}
+			} else if r.stdout != tt.stdout {
+				t.Errorf("stdout %q, want %q", r.stdout, tt.stdout)
+			}
+		})
+	}
+}
+
+func TestTimeoutReader(t *testing.T) {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pr.Close()
+	defer pw.Close()
+	r := &timeoutReader{r: pr, timeout: 100 * time.Millisecond}
+	if _, err := pw.Write([]byte("b,2\n")); err != nil {
+		t.Fatal(err)
+	}
+	p := make([]byte, 16)
+	if n, err := r.Read(p); err != nil || string(p[:n]) != "b,2\n" {
+		t.Errorf("Read = %q, %v; want %q", p[:n], err, "b,2\n")
+	}
+	if _, err := r.Read(p); err == nil || err.Error() != "nothing to read for 100ms" {
+		t.Errorf("Read of a stalled pipe = %v, want the timeout", err)
+	}
+}
+
+// BenchmarkReadFile compares sorting the lines of a file as they are read
+// with reading the file into a slice before sending its lines to the sort.
+func BenchmarkReadFile(b *testing.B) {
+	fn := filepath.Join(b.TempDir(), "in.csv")
+	var in strings.Builder
+	for i := 100000; i > 0; i-- {
+		fmt.Fprintf(&in, "%08d,some text in the second field\n", i)
+	}
+	if err := os.WriteFile(fn, []byte(in.String()), 0644); err != nil {
+		b.Fatal(err)
+	}
+	opts := sorter.Options{}
+	tests := []struct {
+		name string
+		send func(ctx context.Context, lines chan readRow)
+	}{
+		{"streamed", func(ctx context.Context, lines chan readRow) {
+			sendFile(ctx, fn, lines, opts, func([]string) error { return nil })
+		}},
+		{"buffered", func(ctx context.Context, lines chan readRow) {
+			for _, line := range readFile(fn, opts) {
+				lines <- readRow{row: line}
+			}
+		}},
+	}
+	for _, tt := range tests {
+		b.Run(tt.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				ctx := context.Background()
+				lines := make(chan readRow)
+				go func() {
+					tt.send(ctx, lines)
+					close(lines)
+				}()
+				sorted, err := sorter.SortStream(receive(ctx, lines), opts)
+				if err != nil {
+					b.Fatal(err)
+				}
+				sorted.Close()
+			}
+		})
+	}
+}
+
+func TestIsSorted(t *testing.T) {
+	tests := []struct {
+		name, in string
+		args     []string
+		code     int
+		inStderr string
+	}{
+		{"sorted", "a\nb\nb\n", nil, 0, ""},
+		{"unsorted", "a\nc\nb\n", nil, 1, "ERROR: line 3 is out of order"},
+		{"header", "k\na\nc\nb\n", []string{"-h"}, 1, "ERROR: line 4 is out of order"},
+		{"reversed", "c\nb\na\n", []string{"-r"}, 0, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			run(t, "", tt.in, append([]string{"-is-sorted"}, tt.args...)...).expect(t, "", tt.code, tt.inStderr)
+		})
+	}
+}
+
+// gunzipped returns s decompressed.
+func gunzipped(t *testing.T, s string) string {
+	t.Helper()
+	zr, err := gzip.NewReader(strings.NewReader(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestGzipOutput(t *testing.T) {
+	const in, want = "c,3\na,1\nb,2\n", "a,1\nb,2\nc,3\n"
+	tests := []struct {
+		name       string
+		args       []string
+		file       string // the output file, stdout if empty
+		compressed bool
+	}{
+		{"file", []string{"-o", "out.csv.gz"}, "out.csv.gz", true},
+		{"stdout", []string{"-z-out"}, "", true},
+		{"not compressed", []string{"-o", "out.csv"}, "out.csv", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			r := run(t, dir, in, tt.args...)
+			if r.code != 0 {
+				t.Fatalf("exit code %d, stderr %q", r.code, r.stderr)
+			}
+			got := r.stdout
+			if tt.file != "" {
+				b, err := os.ReadFile(filepath.Join(dir, tt.file))
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = string(b)
+				// and it reads back as input
+				run(t, dir, "", "-i", tt.file, "-r").expect(t, "c,3\nb,2\na,1\n", 0, "")
+			}
+			if tt.compressed {
+				got = gunzipped(t, got)
+			}
+			if got != want {
+				t.Errorf("output %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+// failWriter fails the writes after the first n bytes.
+type failWriter struct {
+	n int
+}
+
+var errDiskFull = errors.New("disk full")
+
+func (f *failWriter) Write(p []byte) (int, error) {
+	if len(p) > f.n {
+		n := f.n
+		f.n = 0
+		return n, errDiskFull
+	}
+	f.n -= len(p)
+	return len(p), nil
+}
+
+func TestWriteSumErrors(t *testing.T) {
+	var rows [][]string
+	for i := 0; i < 5000; i++ {
+		rows = append(rows, []string{fmt.Sprint(i), "x"})
+	}
+	tests := []struct {
+		name     string
+		after    int
+		compress bool
+		tee      bool
+	}{
+		{"first write", 0, false, false},
+		{"later write", 10000, false, false},
+		{"compressed", 0, true, false},
+		{"compressed close", 15, true, false},
+		{"with a tee", 100, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tee io.Writer
+			if tt.tee {
+				tee = io.Discard
+			}
+			rd, err := sorter.SortRows(rows, sorter.Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rd.Close()
+			sum, err := writeSum(&failWriter{n: tt.after}, rd, sorter.Options{}, tt.compress, tee)
+			if !errors.Is(err, errDiskFull) || sum != nil {
+				t.Errorf("writeSum = %x, %v; want %v", sum, err, errDiskFull)
+			}
+		})
+	}
+}
+
+func TestWriteErrors(t *testing.T) {
+	if _, err := os.Stat("/dev/full"); err != nil {
+		t.Skip("no /dev/full")
+	}
+	tests := []struct {
+		name     string
+		args     []string
+		inStderr string
+	}{
+		{"file", []string{"-o", "/dev/full"}, "write /dev/full: no space left on device"},
+		{"append", []string{"-o", "/dev/full", "-append"}, "write /dev/full: no space left on device"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			run(t, "", "b\na\n", tt.args...).expect(t, "", 1, tt.inStderr)
+		})
+	}
+}
+
+func TestGroupByFlag(t *testing.T) {
+	const in = "b,2\na,1\nb,3\n"
+	tests := []struct {
+		name     string
+		args     []string
+		want     string
+		code     int
+		inStderr string
+	}{
+		{"sum", []string{"-group-by", "0", "-agg", "sum:1"}, "a,1\nb,5\n", 0, ""},
+		{"count", []string{"-group-by", "0", "-agg", "count:1"}, "a,1\nb,2\n", 0, ""},
+		{"no field", []string{"-group-by", "0", "-agg", "sum"}, "", 1, `ERROR: Invalid aggregation "sum", expected func:N`},
+		{"no group", []string{"-agg", "sum:1"}, "", 1, "aggregations need fields to group by"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			run(t, "", in, tt.args...).expect(t, tt.want, tt.code, tt.inStderr)
+		})
+	}
+}
+
+func TestRejectFile(t *testing.T) {
+	tests := []struct {
+		name, in string
+		args     []string
+		want     string
+		rejected string
+		inStderr string
+	}{
+		{"column count", "b,2\nx\na,1\n", nil, "a,1\nb,2\n", "x\n", "WARNING: 1 lines rejected to rejects.csv"},
+		{"not a number", "b,2\nc,zz\na,1\n", []string{"-n", "-f", "1"}, "a,1\nb,2\n", "c,zz\n", "WARNING: 1 lines rejected"},
+		{"none", "b,2\na,1\n", nil, "a,1\nb,2\n", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			run(t, dir, tt.in, append([]string{"-reject-file", "rejects.csv"}, tt.args...)...).expect(t, tt.want, 0, tt.inStderr)
+			b, err := os.ReadFile(filepath.Join(dir, "rejects.csv"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tt.rejected {
+				t.Errorf("reject file = %q, want %q", b, tt.rejected)
+			}
+		})
+	}
+}
+
+func TestDescribeFlag(t *testing.T) {
+	tests := []struct {
+		name, in string
+		args     []string
+		want     string
+	}{
+		{"mixed", "b,2\na,10\n", nil, "COLUMN  TYPE     MIN  MAX  DISTINCT  NULLS\n" +
+			"0       text     a    b    2         0\n" +
+			"1       numeric  2    10   2         0\n"},
+		{"header", "k,n\nb,\n", []string{"-h"}, "COLUMN  TYPE  MIN  MAX  DISTINCT  NULLS\n" +
+			"k       text  b    b    1         0\n" +
+			"n       text            0         1\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			run(t, "", tt.in, append([]string{"-describe"}, tt.args...)...).expect(t, tt.want, 0, "")
+		})
+	}
+}
+
+// brokenRows returns n rows and then err, like a sort that fails part way
+// through the output.
+type brokenRows struct {
+	n   int
+	err error
+}
+
+func (r *brokenRows) Read() ([]string, error) {
+	if r.n == 0 {
+		return nil, r.err
+	}
+	r.n--
+	return []string{"row", fmt.Sprint(r.n)}, nil
+}
+
+func TestAtomicOutput(t *testing.T) {
+	errBroken := errors.New("broken")
+	tests := []struct {
+		name     string
+		existing bool
+		rows     int
+		err      error
+	}{
+		{"fails at once", true, 0, errBroken},
+		{"fails part way", true, 5000, errBroken},
+		{"fails without a target", false, 5000, errBroken},
+		{"replaces the target", true, 3, io.EOF},
+		{"creates the target", false, 3, io.EOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			name := filepath.Join(dir, "out.csv")
+			if tt.existing {
+				if err := os.WriteFile(name, []byte("old\n"), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			_, err := writeFile(name, &brokenRows{n: tt.rows, err: tt.err}, sorter.Options{})
+			b, rerr := os.ReadFile(name)
+			switch {
+			case tt.err != io.EOF:
+				if !errors.Is(err, errBroken) {
+					t.Errorf("writeFile error = %v, want %v", err, errBroken)
+				}
+				if tt.existing && string(b) != "old\n" {
+					t.Errorf("target = %q after the failure, want it untouched", b)
+				}
+				if !tt.existing && !os.IsNotExist(rerr) {
+					t.Errorf("target exists after the failure: %v", rerr)
+				}
+			case err != nil:
+				t.Errorf("writeFile error = %v", err)
+			case string(b) != "row,2\nrow,1\nrow,0\n":
+				t.Errorf("target = %q", b)
+			}
+			if tt.existing && rerr == nil {
+				if st, err := os.Stat(name); err != nil {
+					t.Error(err)
+				} else if st.Mode().Perm() != 0600 {
+					t.Errorf("target mode = %v, want %v", st.Mode().Perm(), fs.FileMode(0600))
+				}
+			}
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range entries {
+				if e.Name() != "out.csv" {
+					t.Errorf("left %s behind", e.Name())
+				}
+			}
+		})
+	}
+}
+
+func TestLimitFlag(t *testing.T) {
+	dir := t.TempDir()
+	// the lines past the limit would fail the sort if they were read
+	writeFiles(t, dir, map[string]string{
+		"a.csv":   "c\nb\na\nx,y\n",
+		"b.csv":   "k,v\nb,2\na,1\nc\n",
+		"c.csv":   "n\n2\n1\nx,y\n",
+		"d/a.csv": "c\nb\na\nx,y\n",
+	})
+	tests := []struct {
+		name     string
+		args     []string
+		want     string
+		code     int
+		inStderr string
+	}{
+		{"limit", []string{"-i", "a.csv", "-limit", "3"}, "a\nb\nc\n", 0, ""},
+		{"after the header", []string{"-i", "b.csv", "-h", "-limit", "2"}, "k,v\na,1\nb,2\n", 0, ""},
+		{"before a missing file", []string{"-i", "a.csv,missing.csv", "-limit", "2"}, "b\nc\n", 0, ""},
+		{"with progress", []string{"-i", "a.csv", "-limit", "3", "-progress"}, "a\nb\nc\n", 0, "read: 0 files, 3 lines"},
+		{"from a directory", []string{"-d", "d", "-limit", "3"}, "a\nb\nc\n", 0, ""},
+		{"from a directory with progress", []string{"-d", "d", "-limit", "3", "-progress"}, "a\nb\nc\n", 0, "read: 0 files, 3 lines"},
+		{"detecting a header", []string{"-i", "a.csv", "-limit", "3", "-detect-header"}, "a\nb\nc\n", 0, ""},
+		{"detecting a header after the header", []string{"-i", "c.csv", "-limit", "2", "-detect-header"}, "n\n1\n2\n", 0, ""},
+		{"reaching the bad line", []string{"-i", "a.csv", "-limit", "4"}, "", 1, "ERROR: a.csv: line 4 has 2 columns, expected 1"},
+		{"negative", []string{"-i", "a.csv", "-limit", "-1"}, "", 1, "the row limit can't be negative"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 10; i++ {
+				run(t, dir, "", tt.args...).expect(t, tt.want, tt.code, tt.inStderr)
+			}
+		})
+	}
+}
+
+func TestMergeFlagConflicts(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"1.csv": "a\nc\n", "2.csv": "b\n"})
+	tests := []struct {
+		name     string
+		flag     string
+		inStderr string
+	}{
+		{"check", "-check", "-merge only writes the merged lines"},
+		{"bench", "-bench", "-merge only writes the merged lines"},
+		{"is sorted", "-is-sorted", "-merge only writes the merged lines"},
+		{"describe", "-describe", "-merge only writes the merged lines"},
+		{"stats", "-stats", "-merge only writes the merged lines"},
+		{"shuffle", "-shuffle", "-merge can't be used with -shuffle"},
+		{"limit", "-limit=1", "-merge can't be used with -shuffle, -transpose, -detect-header or -limit"},
+		{"from", "-from=2", "a row range can't be used when merging"},
+		{"to", "-to=1", "a row range can't be used when merging"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			run(t, dir, "", "-merge", "-i", "1.csv,2.csv", tt.flag).expect(t, "", 1, tt.inStderr)
+		})
+	}
+}
+
+func TestBenchSkips(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		skipped []string
+	}{
+		{"transpose", []string{"-transpose"}, []string{"merge"}},
+		{"shuffle", []string{"-shuffle", "-seed", "1"}, []string{"merge"}},
+		{"parallel", []string{"-parallel"}, []string{"merge", "tree"}},
+		{"none", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := run(t, "", "1,2\n3,4\n", append([]string{"-bench"}, tt.args...)...)
+			if r.code != 0 {
+				t.Fatalf("exit code %d, stderr %q", r.code, r.stderr)
+			}
+			var skipped []string
+			for _, line := range strings.Split(r.stdout, "\n")[1:] {
+				fields := strings.Fields(line)
+				if len(fields) < 3 {
+					continue
+				}
+				switch fields[2] {
+				case "skipped:":
+					skipped = append(skipped, fields[0])
+				case "same":
+				default:
+					t.Errorf("line %q, want the same output or skipped", line)
+				}
+			}
+			if !reflect.DeepEqual(skipped, tt.skipped) {
+				t.Errorf("skipped %q, want %q\n%s", skipped, tt.skipped, r.stdout)
+			}
+		})
+	}
+}
+
+func TestQuotedFieldsFlag(t *testing.T) {
+	tests := []struct {
+		name, in string
+		args     []string
+		want     string
+	}{
+		{"embedded comma", "\"Smith, John\",42\nAdams,7\n", []string{"-f", "1"}, "\"Smith, John\",42\nAdams,7\n"},
+		{"doubled quotes", "b,2\n\"say \"\"hi\"\"\",1\n", []string{"-f", "1"}, "\"say \"\"hi\"\"\",1\nb,2\n"},
+		{"newline inside quotes", "\"two\nlines\",1\na,2\n", nil, "a,2\n\"two\nlines\",1\n"},
+		{"other delimiter", "\"b;c\";1\na;2\n", []string{"-t", ";"}, "a;2\n\"b;c\";1\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := run(t, "", tt.in, tt.args...)
+			if r.code != 0 || r.stdout != tt.want {
+				t.Errorf("output = %q, exit code %d, stderr %q; want %q", r.stdout, r.code, r.stderr, tt.want)
+			}
+		})
+	}
+}
+
+func TestNumericFlag(t *testing.T) {
+	const in = "10\n9\nx\n2.5\n-1\n"
+	for _, algorithm := range []string{"1", "2"} {
+		t.Run(algorithm, func(t *testing.T) {
+			r := run(t, "", in, "-n", "-a", algorithm)
+			// the value that isn't a number goes before all the numbers
+			if want := "x\n-1\n2.5\n9\n10\n"; r.code != 0 || r.stdout != want {
+				t.Errorf("output = %q, exit code %d, stderr %q; want %q", r.stdout, r.code, r.stderr, want)
+			}
+		})
+	}
+}
+
+func TestIgnoreCaseFlag(t *testing.T) {
+	tests := []struct {
+		name, in string
+		args     []string
+		want     string
+	}{
+		{"mixed case", "Banana\napple\nCherry\n", nil, "apple\nBanana\nCherry\n"},
+		{"reversed", "Banana\napple\nCherry\n", []string{"-r"}, "Cherry\nBanana\napple\n"},
+		{"second field", "x,B\ny,a\n", []string{"-f", "1"}, "y,a\nx,B\n"},
+	}
+	for _, tt := range tests {
+		for _, algorithm := range []string{"1", "2"} {
+			t.Run(tt.name+"/"+algorithm, func(t *testing.T) {
+				r := run(t, "", tt.in, append([]string{"-c", "-a", algorithm}, tt.args...)...)
+				if r.code != 0 || r.stdout != tt.want {
+					t.Errorf("output = %q, exit code %d, stderr %q; want %q", r.stdout, r.code, r.stderr, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestFieldsFlag(t *testing.T) {
+	const in = "b,2,x\na,1,z\nb,1,y\na,2,w\n"
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"second field breaks ties", []string{"-f", "0,1"}, "a,1,z\na,2,w\nb,1,y\nb,2,x\n"},
+		{"reversed on every field", []string{"-f", "0,1", "-r"}, "b,2,x\nb,1,y\na,2,w\na,1,z\n"},
+		{"third field first", []string{"-f", "2,0"}, "a,2,w\nb,2,x\nb,1,y\na,1,z\n"},
+		{"spaces", []string{"-f", "0, 1"}, "a,1,z\na,2,w\nb,1,y\nb,2,x\n"},
+	}
+	for _, tt := range tests {
+		for _, algorithm := range []string{"1", "2"} {
+			t.Run(tt.name+"/"+algorithm, func(t *testing.T) {
+				r := run(t, "", in, append([]string{"-a", algorithm}, tt.args...)...)
+				if r.code != 0 || r.stdout != tt.want {
+					t.Errorf("output = %q, exit code %d, stderr %q; want %q", r.stdout, r.code, r.stderr, tt.want)
+				}
+			})
+		}
+	}
+	if r := run(t, "", in, "-f", "0,x"); r.code != 1 || !strings.Contains(r.stderr, `Invalid field number "x"`) {
+		t.Errorf("-f 0,x: exit code %d, stderr %q", r.code, r.stderr)
+	}
+}
+
+func TestFieldOutOfRangeFlag(t *testing.T) {
+	tests := []struct {
+		name, field, want string
+	}{
+		{"past the end", "5", "ERROR: field 5 out of range (file has 3 columns)"},
+		{"before the start", "-4", "ERROR: field -4 out of range (file has 3 columns)"},
+		{"tie breaker", "0,3", "ERROR: field 3 out of range (file has 3 columns)"},
+	}
+	for _, tt := range tests {
+		for _, algorithm := range []string{"1", "2"} {
+			t.Run(tt.name+"/"+algorithm, func(t *testing.T) {
+				r := run(t, "", "a,b,c\nd,e,f\n", "-f", tt.field, "-a", algorithm)
+				if r.code != 1 || r.stdout != "" || !strings.Contains(r.stderr, tt.want) {
+					t.Errorf("output = %q, exit code %d, stderr %q; want exit code 1 and %q", r.stdout, r.code, r.stderr, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestHeaderWithFewRows(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"empty", "", ""},
+		{"header only", "name,n\n", "name,n\n"},
+		{"one data row", "name,n\nb,1\n", "name,n\nb,1\n"},
+	}
+	for _, tt := range tests {
+		for _, algorithm := range []string{"1", "2"} {
+			t.Run(tt.name+"/"+algorithm, func(t *testing.T) {
+				r := run(t, "", tt.in, "-h", "-a", algorithm)
+				if r.code != 0 || r.stdout != tt.want {
+					t.Errorf("output = %q, exit code %d, stderr %q; want %q", r.stdout, r.code, r.stderr, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestUniqueFlag(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"exact duplicates", "b,1\na,2\nb,1\na,2\na,2\n", "a,2\nb,1\n"},
+		{"differing in another field", "a,1\na,2\na,1\n", "a,1\na,2\n"},
+		{"no duplicates", "c\nb\na\n", "a\nb\nc\n"},
+	}
+	for _, tt := range tests {
+		for _, algorithm := range []string{"1", "2"} {
+			t.Run(tt.name+"/"+algorithm, func(t *testing.T) {
+				r := run(t, "", tt.in, "-u", "-a", algorithm)
+				if r.code != 0 || r.stdout != tt.want {
+					t.Errorf("output = %q, exit code %d, stderr %q; want %q", r.stdout, r.code, r.stderr, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestCountFlag(t *testing.T) {
+	tests := []struct {
+		name, in string
+		args     []string
+		want     string
+	}{
+		{"mixed multiplicities", "b\na\nb\nc\nb\na\n", nil, "2,a\n3,b\n1,c\n"},
+		{"whole rows", "a,1\na,2\na,1\n", nil, "2,a,1\n1,a,2\n"},
+		{"other delimiter", "x;1\nx;1\n", []string{"-t", ";"}, "2;x;1\n"},
+		{"header", "name\nb\nb\n", []string{"-h"}, "count,name\n2,b\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := run(t, "", tt.in, append([]string{"-count"}, tt.args...)...)
+			if r.code != 0 || r.stdout != tt.want {
+				t.Errorf("output = %q, exit code %d, stderr %q; want %q", r.stdout, r.code, r.stderr, tt.want)
+			}
+		})
+	}
+}
+
+func TestHeaderStaysOnTop(t *testing.T) {
+	// the header would sort last, or first in reverse
+	const in = "zone,n\nb,1\na,2\nb,1\n"
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"ascending", nil, "zone,n\na,2\nb,1\nb,1\n"},
+		{"descending", []string{"-r"}, "zone,n\nb,1\nb,1\na,2\n"},
+		{"counted", []string{"-count"}, "count,zone,n\n1,a,2\n2,b,1\n"},
+	}
+	for _, tt := range tests {
+		for _, algorithm := range []string{"1", "2"} {
+			t.Run(tt.name+"/"+algorithm, func(t *testing.T) {
+				r := run(t, "", in, append([]string{"-h", "-a", algorithm}, tt.args...)...)
+				if r.code != 0 || r.stdout != tt.want {
+					t.Errorf("output = %q, exit code %d, stderr %q; want %q", r.stdout, r.code, r.stderr, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestStableFlag(t *testing.T) {
+	// the built in sort.Slice reorders equal rows in slices this long
+	var in, want strings.Builder
+	for i := 0; i < 50; i++ {
+		fmt.Fprintf(&in, "%d,%d\n", i%2, i)
+	}
+	for _, key := range []int{0, 1} {
+		for i := key; i < 50; i += 2 {
+			fmt.Fprintf(&want, "%d,%d\n", key, i)
+		}
+	}
+	if r := run(t, "", in.String(), "-stable"); r.code != 0 || r.stdout != want.String() {
+		t.Errorf("output = %q, exit code %d, stderr %q; want %q", r.stdout, r.code, r.stderr, want.String())
+	}
+}
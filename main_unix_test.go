@@ -0,0 +1,141 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSignalWritesLinesReadSoFar(t *testing.T) {
+	tests := []struct {
+		name   string
+		signal os.Signal
+		inErr  string
+	}{
+		{"SIGTERM", syscall.SIGTERM, "Got kill signal."},
+		{"SIGINT", syscall.SIGINT, "Got CTRL+C signal."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := filepath.Join(t.TempDir(), "out.csv")
+			cmd := exec.Command(os.Args[0], "-o", out)
+			cmd.Env = append(os.Environ(), "CSORT_TEST_MAIN=1")
+			var stderr strings.Builder
+			cmd.Stderr = &stderr
+			stdin, err := cmd.StdinPipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := cmd.Start(); err != nil {
+				t.Fatal(err)
+			}
+			// the input stays open, like a long run still reading
+			fmt.Fprint(stdin, "c,3\na,1\nb,2\n")
+			time.Sleep(300 * time.Millisecond)
+			cmd.Process.Signal(tt.signal)
+			err = cmd.Wait()
+			stdin.Close()
+
+			var ee *exec.ExitError
+			if !errors.As(err, &ee) || ee.ExitCode() != 1 {
+				t.Errorf("exit error = %v, want exit code 1", err)
+			}
+			for _, want := range []string{tt.inErr, "Writing the lines read so far.", "Program will terminate now."} {
+				if !strings.Contains(stderr.String(), want) {
+					t.Errorf("stderr %q doesn't have %q", stderr.String(), want)
+				}
+			}
+			if b, err := os.ReadFile(out); err != nil || string(b) != "a,1\nb,2\nc,3\n" {
+				t.Errorf("output = %q, %v; want the lines sent, sorted", b, err)
+			}
+		})
+	}
+}
+
+func TestOtherSignalsIgnored(t *testing.T) {
+	for _, sig := range []syscall.Signal{syscall.SIGURG, syscall.SIGWINCH} {
+		t.Run(sig.String(), func(t *testing.T) {
+			cmd := exec.Command(os.Args[0])
+			cmd.Env = append(os.Environ(), "CSORT_TEST_MAIN=1")
+			var stdout, stderr strings.Builder
+			cmd.Stdout, cmd.Stderr = &stdout, &stderr
+			stdin, err := cmd.StdinPipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := cmd.Start(); err != nil {
+				t.Fatal(err)
+			}
+			fmt.Fprint(stdin, "b\n")
+			time.Sleep(200 * time.Millisecond)
+			cmd.Process.Signal(sig)
+			fmt.Fprint(stdin, "a\n")
+			stdin.Close()
+			if err := cmd.Wait(); err != nil {
+				t.Errorf("exit error = %v", err)
+			}
+			if stdout.String() != "a\nb\n" || stderr.String() != "" {
+				t.Errorf("output = %q, stderr %q; want all the lines and nothing on stderr", stdout.String(), stderr.String())
+			}
+		})
+	}
+}
+
+func TestFIFOInput(t *testing.T) {
+	tests := []struct {
+		name     string
+		write    func(fn string) // what the other end does, in its own goroutine
+		want     string
+		code     int
+		inStderr string
+	}{
+		{"written", func(fn string) {
+			os.WriteFile(fn, []byte("b,2\na,1\n"), 0644)
+		}, "a,1\nb,2\n", 0, ""},
+		{"written slowly", func(fn string) {
+			f, err := os.OpenFile(fn, os.O_WRONLY, 0)
+			if err != nil {
+				return
+			}
+			defer f.Close()
+			for _, line := range []string{"c,3\n", "a,1\n", "b,2\n"} {
+				f.WriteString(line)
+				time.Sleep(50 * time.Millisecond)
+			}
+		}, "a,1\nb,2\nc,3\n", 0, ""},
+		{"never opened", nil, "", 1, "nothing opened it for writing in 300ms"},
+		{"nothing written", func(fn string) {
+			f, err := os.OpenFile(fn, os.O_WRONLY, 0)
+			if err != nil {
+				return
+			}
+			time.Sleep(time.Second)
+			f.Close()
+		}, "", 1, "nothing to read for 300ms"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fn := filepath.Join(t.TempDir(), "fifo")
+			if err := syscall.Mkfifo(fn, 0644); err != nil {
+				t.Skip("no FIFOs:", err)
+			}
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				if tt.write != nil {
+					tt.write(fn)
+				}
+			}()
+			run(t, "", "", "-i", fn, "-timeout", "300ms").expect(t, tt.want, tt.code, tt.inStderr)
+			<-done
+		})
+	}
+}
@@ -0,0 +1,32 @@
+package sorter
+
+import (
+	"fmt"
+	"sync"
+
+	"golang.org/x/text/collate"
+	"golang.org/x/text/language"
+)
+
+// supportedLocales matches tags to the languages collate has tables for.
+var supportedLocales = language.NewMatcher(collate.Supported())
+
+// compareLocale returns a comparison of text in the language of the BCP 47
+// tag. Tags that aren't well formed, or of a language without a collation
+// table, are an error rather than comparing like some other language.
+func compareLocale(tag string) (compareFunc, error) {
+	t, err := language.Parse(tag)
+	if err != nil {
+		return nil, fmt.Errorf("invalid locale %q: %v", tag, err)
+	}
+	if _, _, conf := supportedLocales.Match(t); conf == language.No {
+		return nil, fmt.Errorf("no collation for the locale %q", tag)
+	}
+	// a Collator keeps buffers, so the -parallel sorts each take their own
+	collators := sync.Pool{New: func() any { return collate.New(t) }}
+	return func(a, b string) int {
+		c := collators.Get().(*collate.Collator)
+		defer collators.Put(c)
+		return c.CompareString(a, b)
+	}, nil
+}
@@ -0,0 +1,54 @@
+package sorter
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLocale(t *testing.T) {
+	const in = "zoo\nöl\nÄpfel\nApfel\nolive\nbar\n"
+	tests := []struct {
+		name   string
+		locale string
+		want   []string
+	}{
+		{"bytes", "", []string{"Apfel", "bar", "olive", "zoo", "Äpfel", "öl"}},
+		{"german", "de", []string{"Apfel", "Äpfel", "bar", "öl", "olive", "zoo"}},
+		// Swedish puts Ä and Ö at the end of the alphabet
+		{"swedish", "sv", []string{"Apfel", "bar", "olive", "zoo", "Äpfel", "öl"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := sortString(t, in, Options{Locale: tt.locale, Stable: true})
+			if want := strings.Join(tt.want, "\n") + "\n"; got != want {
+				t.Errorf("Sort = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestCompareLocale(t *testing.T) {
+	tests := []struct {
+		tag  string
+		a, b string
+		want int
+	}{
+		{"de", "é", "z", -1},
+		{"de", "öl", "olive", -1},
+		{"de", "öl", "zoo", -1},
+		{"sv", "öl", "zoo", 1},
+		{"fr", "cote", "côte", -1},
+	}
+	for _, tt := range tests {
+		compare, err := compareLocale(tt.tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := sign(compare(tt.a, tt.b)); got != tt.want {
+			t.Errorf("compareLocale(%q)(%q, %q) = %d, want %d", tt.tag, tt.a, tt.b, got, tt.want)
+		}
+	}
+	if _, err := compareLocale("!!"); err == nil || !strings.HasPrefix(err.Error(), `invalid locale "!!"`) {
+		t.Errorf("compareLocale(%q) error = %v", "!!", err)
+	}
+}
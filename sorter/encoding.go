@@ -0,0 +1,38 @@
+package sorter
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+// encodings are the input encodings Options.Encoding takes besides UTF-8.
+// A UTF-16 byte order mark sets the byte order and is dropped.
+var encodings = map[string]encoding.Encoding{
+	"utf-16":     unicode.UTF16(unicode.LittleEndian, unicode.UseBOM), // little endian without a BOM
+	"utf-16le":   unicode.UTF16(unicode.LittleEndian, unicode.UseBOM),
+	"utf-16be":   unicode.UTF16(unicode.BigEndian, unicode.UseBOM),
+	"latin1":     charmap.ISO8859_1,
+	"iso-8859-1": charmap.ISO8859_1,
+}
+
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// decodeInput returns a reader of r decoded from the encoding to UTF-8,
+// with any byte order mark dropped.
+func decodeInput(r io.Reader, encoding string) io.Reader {
+	if enc, ok := encodings[strings.ToLower(encoding)]; ok {
+		return transform.NewReader(r, enc.NewDecoder())
+	}
+	br := bufio.NewReader(r)
+	if bom, _ := br.Peek(len(utf8BOM)); bytes.Equal(bom, utf8BOM) {
+		br.Discard(len(utf8BOM))
+	}
+	return br
+}
@@ -0,0 +1,47 @@
+package sorter
+
+import (
+	"testing"
+	"unicode/utf16"
+)
+
+// utf16Bytes encodes s in UTF-16 with a byte order mark.
+func utf16Bytes(s string, bigEndian bool) string {
+	var b []byte
+	for _, u := range utf16.Encode([]rune("\ufeff" + s)) {
+		if bigEndian {
+			b = append(b, byte(u>>8), byte(u))
+		} else {
+			b = append(b, byte(u), byte(u>>8))
+		}
+	}
+	return string(b)
+}
+
+func TestEncodings(t *testing.T) {
+	const want = "ä,1\nö,2\nü,3\n"
+	tests := []struct {
+		name, in, encoding string
+	}{
+		{"utf-16le", utf16Bytes("ü,3\nä,1\nö,2\n", false), "utf-16le"},
+		{"utf-16 with a big endian BOM", utf16Bytes("ü,3\nä,1\nö,2\n", true), "utf-16"},
+		{"utf-16be", utf16Bytes("ü,3\nä,1\nö,2\n", true), "UTF-16BE"},
+		{"latin1", "\xfc,3\n\xe4,1\n\xf6,2\n", "latin1"},
+		{"utf-8 with a BOM", "\xef\xbb\xbfü,3\nä,1\nö,2\n", ""},
+		{"utf-8", "ü,3\nä,1\nö,2\n", "utf-8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sortString(t, tt.in, Options{Encoding: tt.encoding}); got != want {
+				t.Errorf("Sort = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestUnknownEncoding(t *testing.T) {
+	_, err := trySort("a\n", Options{Encoding: "ebcdic"})
+	if want := `unknown encoding "ebcdic"`; err == nil || err.Error() != want {
+		t.Errorf("Sort error = %v, want %q", err, want)
+	}
+}
@@ -0,0 +1,338 @@
+package sorter
+
+import (
+	"container/heap"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+const DefaultChunk = 100000
+
+// externalSort sorts rows that may not fit in memory. Every opts.Chunk rows
+// are sorted and spilled to a temporary file, and the returned rows merge
+// the files as they are read. Closing them removes the files.
+func externalSort(next func() ([]string, bool), opts Options) (*Rows, error) {
+	chunk := opts.Chunk
+	if chunk <= 0 {
+		chunk = DefaultChunk
+	}
+	dir, err := os.MkdirTemp("", "sort-chunks")
+	if err != nil {
+		return nil, err
+	}
+	r, err := spillRuns(dir, next, chunk, opts)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return r, nil
+}
+
+func spillRuns(dir string, next func() ([]string, bool), chunk int, opts Options) (*Rows, error) {
+	var head [][]string
+	var runs []string
+	var compareRows func(a, b []string) int
+	var less func(a, b []string) bool
+	buff := make([][]string, 0, chunk)
+	spill := func() error {
+		sort.SliceStable(buff, func(i, j int) bool {
+			return less(buff[i], buff[j])
+		})
+		fn := filepath.Join(dir, strconv.Itoa(len(runs)))
+		if err := writeRun(fn, buff); err != nil {
+			return err
+		}
+		runs = append(runs, fn)
+		buff = buff[:0]
+		return nil
+	}
+
+	first := true
+	for row, ok := next(); ok; row, ok = next() {
+		if first {
+			first = false
+			if err := opts.resolveFields(row); err != nil {
+				return nil, err
+			}
+			compareRows = opts.byFields()
+			less = lessFunc(compareRows, opts.Order)
+		}
+		if len(head) < opts.HeaderRows() {
+			head = append(head, row)
+			continue
+		}
+		buff = append(buff, row)
+		if len(buff) == chunk {
+			if err := spill(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(buff) > 0 {
+		if err := spill(); err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := mergeRuns(dir, runs, less)
+	if err != nil {
+		return nil, err
+	}
+	return &Rows{RowReader: finishRows(head, data, compareRows, opts), close: data.close}, nil
+}
+
+func writeRun(fn string, rows [][]string) error {
+	f, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	enc := gob.NewEncoder(f)
+	for _, row := range rows {
+		if err := enc.Encode(row); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// mergeRuns opens the sorted run files for merging. Rows that are equal
+// come from the earlier run first, so the merge keeps the input order of
+// equal rows.
+func mergeRuns(dir string, runs []string, less func(a, b []string) bool) (*mergeReader, error) {
+	m := &mergeReader{dir: dir, heap: &mergeHeap{less: less}}
+	for i, fn := range runs {
+		f, err := os.Open(fn)
+		if err != nil {
+			m.close()
+			return nil, err
+		}
+		m.files = append(m.files, f)
+		m.runs = append(m.runs, &gobRun{gob.NewDecoder(f)})
+		if err := m.heap.pushNext(m.runs[i], i); err != nil {
+			m.close()
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// gobRun reads the rows of a run file.
+type gobRun struct {
+	dec *gob.Decoder
+}
+
+func (g *gobRun) Read() ([]string, error) {
+	var row []string
+	if err := g.dec.Decode(&row); err != nil {
+		return nil, err
+	}
+	return row, nil
+}
+
+// Merge reads delimited rows from the inputs, each already sorted as opts
+// says, and writes them to w in one sorted stream without sorting them
+// again. With a header every input starts with one and only the first is
+// written. Merge fails on the first row out of order.
+func Merge(inputs []io.Reader, w io.Writer, opts Options) error {
+	readers := make([]*Reader, len(inputs))
+	names := make([]string, len(inputs))
+	for i, in := range inputs {
+		rd, err := NewReader(in, opts)
+		if err != nil {
+			return err
+		}
+		// the inputs use the delimiter detected from the first
+		opts = rd.opts
+		readers[i], names[i] = rd, fmt.Sprintf("input %d", i+1)
+	}
+	merged, err := MergeReaders(readers, names, opts)
+	if err != nil {
+		return err
+	}
+	return WriteRows(w, merged, opts)
+}
+
+// MergeReaders merges the rows of the readers, which must each be sorted
+// already, with a heap of their next rows. Rows that are equal come from
+// the earlier reader first.
+func MergeReaders(readers []*Reader, names []string, opts Options) (RowReader, error) {
+	if opts.Limit > 0 {
+		// the first rows read aren't the first ones merged
+		return nil, errors.New("the row limit can't be used when merging")
+	}
+	if opts.From > 0 || opts.To > 0 {
+		// nor are the row numbers of the inputs those of the merged rows
+		return nil, errors.New("a row range can't be used when merging")
+	}
+	var head [][]string
+	var firsts [][]string
+	var runs []*sortedRun
+	for i, r := range readers {
+		// every input starts with the header, the first one's is kept
+		var top [][]string
+		for len(top) < opts.HeaderRows() {
+			row, err := r.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", names[i], err)
+			}
+			top = append(top, row)
+		}
+		if head == nil {
+			head = top
+		}
+		run := &sortedRun{r: r, name: names[i], opts: opts}
+		first, err := run.next()
+		if err == io.EOF {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(runs) > 0 && len(first) != len(firsts[0]) && !opts.Ragged {
+			return nil, fmt.Errorf("%s has %d columns, expected %d like in %s", names[i], len(first), len(firsts[0]), runs[0].name)
+		}
+		runs = append(runs, run)
+		firsts = append(firsts, first)
+	}
+
+	// the fields are checked against the first row, the header if there is one
+	if rows := append(head, firsts...); len(rows) > 0 {
+		if err := opts.resolveFields(rows[0]); err != nil {
+			return nil, err
+		}
+	}
+	compareRows := opts.byFields()
+	less := lessFunc(compareRows, opts.Order)
+	m := &mergeReader{heap: &mergeHeap{less: less}}
+	for i, run := range runs {
+		run.less, run.prev = less, firsts[i]
+		m.runs = append(m.runs, run)
+		heap.Push(m.heap, mergeItem{row: firsts[i], run: i})
+	}
+	return finishRows(head, m, compareRows, opts), nil
+}
+
+// sortedRun reads the rows of an input that must already be sorted, and
+// fails on the first row sorting before the one read last.
+type sortedRun struct {
+	r    *Reader
+	name string
+	opts Options
+	less func(a, b []string) bool
+	prev []string
+}
+
+func (s *sortedRun) Read() ([]string, error) {
+	row, err := s.next()
+	if err != nil {
+		return nil, err
+	}
+	if s.less(row, s.prev) {
+		return nil, fmt.Errorf("%s: line %d is out of order, the input isn't sorted", s.name, s.r.r.Line())
+	}
+	s.prev = row
+	return row, nil
+}
+
+// next reads the next row Filters keep.
+func (s *sortedRun) next() ([]string, error) {
+	for {
+		row, err := s.r.Next()
+		if err == io.EOF {
+			return nil, err
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", s.name, err)
+		}
+		if s.opts.keep(row) {
+			return row, nil
+		}
+	}
+}
+
+// mergeReader returns the smallest row among the heads of the runs. close
+// removes the run files.
+type mergeReader struct {
+	dir   string
+	files []*os.File
+	runs  []RowReader
+	heap  *mergeHeap
+}
+
+func (m *mergeReader) Read() ([]string, error) {
+	if m.heap.Len() == 0 {
+		return nil, io.EOF
+	}
+	item := heap.Pop(m.heap).(mergeItem)
+	if err := m.heap.pushNext(m.runs[item.run], item.run); err != nil {
+		return nil, err
+	}
+	return item.row, nil
+}
+
+func (m *mergeReader) close() error {
+	for _, f := range m.files {
+		f.Close()
+	}
+	m.files = nil
+	if m.dir == "" {
+		return nil
+	}
+	return os.RemoveAll(m.dir)
+}
+
+type mergeItem struct {
+	row []string
+	run int
+}
+
+type mergeHeap struct {
+	items []mergeItem
+	less  func(a, b []string) bool
+}
+
+func (h *mergeHeap) Len() int { return len(h.items) }
+
+func (h *mergeHeap) Less(i, j int) bool {
+	a, b := h.items[i], h.items[j]
+	if h.less(a.row, b.row) {
+		return true
+	}
+	if h.less(b.row, a.row) {
+		return false
+	}
+	return a.run < b.run
+}
+
+func (h *mergeHeap) Swap(i, j int) { h.items[i], h.items[j] = h.items[j], h.items[i] }
+
+func (h *mergeHeap) Push(x any) { h.items = append(h.items, x.(mergeItem)) }
+
+func (h *mergeHeap) Pop() any {
+	item := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return item
+}
+
+// pushNext reads the next row of the run onto the heap, if there is one.
+func (h *mergeHeap) pushNext(r RowReader, run int) error {
+	row, err := r.Read()
+	if err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+	heap.Push(h, mergeItem{row: row, run: run})
+	return nil
+}
@@ -0,0 +1,153 @@
+package sorter
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExternalSort(t *testing.T) {
+	const in = "d,4\nb,2\ne,5\na,1\nc,3\nb,0\n"
+	tests := []struct {
+		name string
+		in   string
+		opts Options
+	}{
+		{"one row runs", in, Options{Chunk: 1}},
+		{"two row runs", in, Options{Chunk: 2}},
+		{"one run", in, Options{Chunk: 100}},
+		{"second field", in, Options{Chunk: 2, Fields: []int{1}, Numeric: true}},
+		{"descending", in, Options{Chunk: 2, Order: Descending}},
+		{"delimiter", strings.ReplaceAll(in, ",", ";"), Options{Chunk: 2, Delimiter: ";"}},
+		{"header", "k,v\n" + in, Options{Chunk: 2, Header: true}},
+		{"empty", "", Options{Chunk: 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := tt.opts
+			want.Chunk, want.Stable = 0, true
+			merge := tt.opts
+			merge.Algorithm = "merge"
+			got, wantOut := sortString(t, tt.in, merge), sortString(t, tt.in, want)
+			if got != wantOut {
+				t.Errorf("merge sort = %q, built in sort = %q", got, wantOut)
+			}
+		})
+	}
+}
+
+// spillDir points the temporary directory of the merge sort at a new one
+// and returns it.
+func spillDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("TMPDIR", dir)
+	return dir
+}
+
+func TestExternalSortSpills(t *testing.T) {
+	dir := spillDir(t)
+	var rows [][]string
+	for i := 9; i >= 0; i-- {
+		rows = append(rows, []string{fmt.Sprint(i)})
+	}
+	sorted, err := SortRows(rows, Options{Algorithm: "merge", Chunk: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	runs, _ := filepath.Glob(filepath.Join(dir, "sort-chunks*", "*"))
+	if len(runs) != 4 {
+		t.Errorf("%d run files for 10 rows of 3, want 4", len(runs))
+	}
+	for i := 0; i < 10; i++ {
+		row, err := sorted.Read()
+		if err != nil {
+			t.Fatalf("row %d: %v", i, err)
+		}
+		if row[0] != fmt.Sprint(i) {
+			t.Errorf("row %d = %v", i, row)
+		}
+	}
+	if err := sorted.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExternalSortCleanup(t *testing.T) {
+	tests := []struct {
+		name string
+		read int
+	}{
+		{"none read", 0},
+		{"some read", 2},
+		{"all read", 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := spillDir(t)
+			rows := [][]string{{"g"}, {"c"}, {"e"}, {"a"}, {"f"}, {"b"}, {"d"}}
+			sorted, err := SortRows(rows, Options{Algorithm: "merge", Chunk: 2})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < tt.read; i++ {
+				if _, err := sorted.Read(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := sorted.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err := sorted.Close(); err != nil {
+				t.Errorf("second Close: %v", err)
+			}
+			if left, _ := os.ReadDir(dir); len(left) != 0 {
+				t.Errorf("%d files left after Close", len(left))
+			}
+		})
+	}
+}
+
+func TestMerge(t *testing.T) {
+	tests := []struct {
+		name   string
+		inputs []string
+		opts   Options
+		want   string
+		err    string
+	}{
+		{"three files", []string{"a,1\nd,4\ng,7\n", "b,2\ne,5\n", "c,3\nf,6\nh,8\n"}, Options{}, "a,1\nb,2\nc,3\nd,4\ne,5\nf,6\ng,7\nh,8\n", ""},
+		{"equal keys keep the input order", []string{"a,1\nb,1\n", "a,2\n", "a,3\nb,3\n"}, Options{}, "a,1\na,2\na,3\nb,1\nb,3\n", ""},
+		{"descending", []string{"c\na\n", "d\nb\n"}, Options{Order: Descending}, "d\nc\nb\na\n", ""},
+		{"numeric field", []string{"x,2\ny,10\n", "z,9\n"}, Options{Fields: []int{1}, Numeric: true}, "x,2\nz,9\ny,10\n", ""},
+		{"header", []string{"k\na\nc\n", "k\nb\n"}, Options{Header: true}, "k\na\nb\nc\n", ""},
+		{"empty input", []string{"", "a\n"}, Options{}, "a\n", ""},
+		{"unsorted", []string{"a\nc\n", "d\nb\n"}, Options{}, "", "input 2: line 2 is out of order, the input isn't sorted"},
+		{"columns", []string{"a,1\n", "b\n"}, Options{}, "", "input 2 has 1 columns, expected 2 like in input 1"},
+		{"limit", []string{"a\n"}, Options{Limit: 1}, "", "the row limit can't be used when merging"},
+		{"from", []string{"a\n", "b\n"}, Options{From: 2}, "", "a row range can't be used when merging"},
+		{"to", []string{"a\n", "b\n"}, Options{To: 1}, "", "a row range can't be used when merging"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var inputs []io.Reader
+			for _, in := range tt.inputs {
+				inputs = append(inputs, strings.NewReader(in))
+			}
+			var out strings.Builder
+			err := Merge(inputs, &out, tt.opts)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Errorf("Merge error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil || out.String() != tt.want {
+				t.Errorf("Merge = %q, %v; want %q", out.String(), err, tt.want)
+			}
+		})
+	}
+}
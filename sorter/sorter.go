@@ -0,0 +1,2174 @@
+// Package sorter reads the rows of delimited or fixed-width files, sorts
+// them by one or more fields and writes them back out.
+package sorter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+type Node struct {
+	data   []string
+	left   *Node
+	right  *Node
+	height int
+}
+type Tree struct {
+	root *Node
+}
+
+const DefaultMaxLine = 1 << 20
+
+// AutoDelimiter as the delimiter makes it detected from the input.
+const AutoDelimiter = "auto"
+
+// delimiterCandidates are the delimiters detectDelimiter chooses from.
+var delimiterCandidates = []string{",", "\t", ";", "|"}
+
+// Options controls how Sort reads, orders and writes rows.
+// The zero value sorts comma-separated rows by the first field.
+type Options struct {
+	Fields     []int   // fields to sort by, later ones break ties, negative ones count from the end
+	Orders     []Order // order of the field at the same index in Fields, Ascending if there is none
+	Nulls      string  // first or last to put fields equal to NullValue there in any order
+	NullValue  string  // value of null fields
+	FieldName  string  // header name of the field to sort by, implies Header
+	AllowDups  bool    // let FieldName take the first of header columns with the same name
+	Order      Order   // direction of the whole sort, Ascending by default
+	Header     bool    // keep the first row on top and out of sorting
+	HeadLines  int     // keep this many first rows on top and out of sorting, like Header for 1
+	AutoHeader bool    // set Header if the first row looks like a header
+	Delimiter  string  // field delimiter, a comma if empty, detected from the first lines if "auto"
+	OutDelim   string  // output field delimiter, Delimiter if empty
+	MaxLine    int     // longest line allowed in bytes, 1MB if 0
+	SkipBlank  bool    // skip blank lines instead of failing on them
+	Ragged     bool    // pad short rows with empty fields instead of failing on them
+	Trim       bool    // remove the whitespace around fields
+	Comment    rune    // ASCII character starting lines to skip, none if 0
+	Encoding   string  // encoding of the input, UTF-8 if empty, see encodings
+	Widths     []int   // widths in bytes of fixed-width fields to read instead of delimited ones
+	OutWidths  []int   // widths to pad the output fields to instead of delimiting them
+	Quote      rune    // ASCII character quoting fields, a double quote if 0
+	Algorithm  string  // builtin (default), tree or merge for the external merge sort
+	Chunk      int     // rows an external merge sort keeps in memory, 100000 if 0
+	Numeric    bool    // compare fields as numbers
+	Thousands  string  // thousands separator to drop from numbers
+	Units      bool    // multiply numbers ending in K, M or G by 1000, a million or a billion
+	IgnoreCase bool    // compare fields ignoring case
+	Blanks     bool    // compare fields ignoring leading spaces and tabs
+	KeyStart   int     // compare fields from this byte on
+	KeyEnd     int     // compare fields up to this byte, to the end if 0
+	Natural    bool    // compare runs of digits inside fields as numbers
+	Version    bool    // compare fields as dotted versions, like 1.2.10
+	DateLayout string  // compare fields as times in this time.Parse layout
+	Month      bool    // compare fields as month names, Jan or January
+	IP         bool    // compare fields as IPv4 or IPv6 addresses
+	Locale     string  // BCP 47 tag of the language to collate text fields in, byte order if empty
+	ByLength   bool    // compare fields by their length in characters, then as the other options say
+	Hash       bool    // compare fields by their FNV-1a hash, a random order that is the same every run
+	Buckets    int     // add a column with the hash of the first sort field modulo Buckets if not 0
+	Stable     bool    // keep the input order of rows with equal keys
+	Parallel   bool    // sort parts of the rows on all CPUs and merge them, stable like Stable
+	Shuffle    bool    // put the rows in a random order instead of sorting them
+	Transpose  bool    // swap rows and columns before sorting
+	Seed       int64   // seed of the random order
+	Unique     bool    // drop identical rows
+	Count      bool    // drop identical rows and prefix the rest with their number
+	GroupBy    []int   // merge runs of sorted rows with equal values of these fields into one
+	Aggs       []Aggregate
+	Format     string // csv (default), tsv, json for arrays, json-objects keyed by header or table
+	MaxWidth   int    // cut the table format cells to this many characters if not 0
+	CRLF       bool   // end output lines with \r\n instead of \n
+	Columns    []int  // fields to output in this order after sorting, all if empty
+	From       int    // sort only the rows from this one on, counting from 1 without the header, if not 0
+	To         int    // sort only the rows up to and including this one if not 0
+	Limit      int    // read only this many rows after the header if not 0, before From and To
+	Head       int    // output only the first Head sorted rows if not 0
+	Tail       int    // output only the last Tail sorted rows if not 0
+	Number     bool   // prefix the output rows with their 1-based number
+	Filters    []Filter
+	Stats      *Stats // filled in while sorting if not nil
+	// Reject, if set, takes the rows with the wrong number of columns or,
+	// with Numeric, a sort field that isn't a number instead of failing.
+	Reject func(row []string, err error)
+}
+
+// Order is the direction rows are sorted in.
+type Order int
+
+const (
+	Ascending Order = iota
+	Descending
+)
+
+// Stats are statistics of a sort.
+type Stats struct {
+	Rows       int    // rows read, without the header
+	Columns    int    // columns of the first row
+	Duplicates int    // rows dropped by Unique or Count
+	Min, Max   string // smallest and largest value of the first sort field
+}
+
+// Aggregate sets the Field of a GroupBy row to the Func of the values the
+// group has in it: sum, count, first or last.
+type Aggregate struct {
+	Func  string
+	Field int
+}
+
+// Filter keeps only the rows with the Field matching Pattern. Rows must
+// match every filter to be sorted.
+type Filter struct {
+	Field   int
+	Pattern *regexp.Regexp
+}
+
+// keep reports whether the row matches all the filters.
+func (o Options) keep(row []string) bool {
+	for _, f := range o.Filters {
+		if f.Field < 0 || f.Field >= len(row) || !f.Pattern.MatchString(row[f.Field]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Validate reports the first problem with the options, which Sort,
+// SortStream, SortRows and NewReader check too.
+func (o Options) Validate() error {
+	if o.Head < 0 || o.Tail < 0 {
+		return errors.New("the number of head or tail rows can't be negative")
+	}
+	for _, order := range append([]Order{o.Order}, o.Orders...) {
+		if order != Ascending && order != Descending {
+			return fmt.Errorf("invalid order %d", order)
+		}
+	}
+	if o.Nulls != "" && o.Nulls != "first" && o.Nulls != "last" {
+		return fmt.Errorf("nulls can go first or last, not %q", o.Nulls)
+	}
+	if o.Locale != "" {
+		if _, err := compareLocale(o.Locale); err != nil {
+			return err
+		}
+	}
+	if o.Thousands != "" && o.Thousands == o.delimiter() {
+		return errors.New("the thousands separator and the delimiter can't be the same")
+	}
+	if o.KeyStart < 0 || o.KeyEnd < 0 || (o.KeyEnd > 0 && o.KeyEnd <= o.KeyStart) {
+		return errors.New("the key must start at 0 or later and end after it starts")
+	}
+	if o.Head > 0 && o.Tail > 0 {
+		return errors.New("head and tail can't be used at the same time")
+	}
+	if o.Shuffle && (o.Unique || o.Count) {
+		return errors.New("shuffled rows can't be made unique or counted")
+	}
+	if _, ok := algorithms[o.algorithm()]; !ok {
+		return fmt.Errorf("unknown sorting algorithm %q, valid ones are %s", o.Algorithm, strings.Join(Algorithms(), ", "))
+	}
+	if o.Parallel && o.algorithm() != "builtin" {
+		return errors.New("only the built in sort can run in parallel")
+	}
+	if o.Ragged && o.Algorithm == mergeAlgorithm {
+		return errors.New("the external merge sort can't pad ragged rows")
+	}
+	if o.Transpose && o.Algorithm == mergeAlgorithm {
+		return errors.New("the external merge sort can't transpose rows")
+	}
+	if o.Shuffle && o.Algorithm == mergeAlgorithm {
+		return errors.New("shuffling isn't supported by the external merge sort")
+	}
+	if e := strings.ToLower(o.Encoding); e != "" && e != "utf-8" && encodings[e] == nil {
+		return fmt.Errorf("unknown encoding %q", o.Encoding)
+	}
+	for _, w := range append(o.Widths, o.OutWidths...) {
+		if w <= 0 {
+			return errors.New("field widths must be positive")
+		}
+	}
+	if o.Comment >= utf8.RuneSelf || o.Comment == ' ' || o.Comment == '\t' || o.Comment == '\r' || o.Comment == '\n' {
+		return errors.New("the comment must be a single ASCII character")
+	}
+	if o.Comment != 0 && o.Comment == o.quote() {
+		return errors.New("the comment and the quote can't be the same")
+	}
+	if o.Quote >= utf8.RuneSelf || o.Quote == '\r' || o.Quote == '\n' {
+		return errors.New("the quote must be a single ASCII character")
+	}
+	if comma, ok := singleRune(o.delimiter()); ok && comma == o.quote() {
+		return errors.New("the quote and the delimiter can't be the same")
+	}
+	if comma, ok := singleRune(o.OutDelim); ok && comma == o.quote() {
+		return errors.New("the quote and the output delimiter can't be the same")
+	}
+	if o.OutDelim == AutoDelimiter {
+		return errors.New("only the input delimiter can be detected")
+	}
+	switch o.Format {
+	case "", "csv", "tsv", "json", "table":
+	case "json-objects":
+		if !o.header() && !o.AutoHeader {
+			return errors.New("the json-objects format needs a header to take the keys from")
+		}
+		if o.HeadLines > 1 {
+			return errors.New("the json-objects format takes the keys from a single header line")
+		}
+	default:
+		return fmt.Errorf("unknown output format %q", o.Format)
+	}
+	for _, a := range o.Aggs {
+		switch a.Func {
+		case "sum", "count", "first", "last":
+		default:
+			return fmt.Errorf("unknown aggregation %q, expected sum, count, first or last", a.Func)
+		}
+	}
+	if len(o.Aggs) > 0 && len(o.GroupBy) == 0 {
+		return errors.New("aggregations need fields to group by")
+	}
+	if len(o.GroupBy) > 0 && (o.Unique || o.Count) {
+		return errors.New("grouping already leaves one row for each group, it can't be used with unique or count")
+	}
+	if o.Buckets < 0 {
+		return errors.New("the number of buckets can't be negative")
+	}
+	if o.HeadLines < 0 {
+		return errors.New("the number of header lines can't be negative")
+	}
+	if o.Limit < 0 {
+		return errors.New("the row limit can't be negative")
+	}
+	if o.From < 0 || o.To < 0 {
+		return errors.New("the row range can't be negative")
+	}
+	if o.To > 0 && o.To < o.From {
+		return errors.New("the row range ends before it starts")
+	}
+	if o.MaxWidth < 0 || o.MaxWidth > 0 && o.Format != "table" {
+		return errors.New("the maximum column width needs the table format and can't be negative")
+	}
+	if (o.OutDelim != "" || o.OutWidths != nil) && !o.Delimited() {
+		return fmt.Errorf("the %s format has no output delimiter or widths", o.Format)
+	}
+	return nil
+}
+
+// Delimited reports whether the output format writes delimited fields.
+func (o Options) Delimited() bool {
+	return o.Format == "" || o.Format == "csv" || o.Format == "tsv"
+}
+
+func (o Options) algorithm() string {
+	if o.Algorithm == "" {
+		return "builtin"
+	}
+	return o.Algorithm
+}
+
+func (o Options) delimiter() string {
+	if o.Delimiter == "" {
+		return ","
+	}
+	return o.Delimiter
+}
+
+func (o Options) outDelimiter() string {
+	if o.Format == "tsv" && o.OutDelim == "" {
+		return "\t"
+	}
+	if o.OutDelim == "" {
+		return o.delimiter()
+	}
+	return o.OutDelim
+}
+
+func (o Options) quote() rune {
+	if o.Quote == 0 {
+		return '"'
+	}
+	return o.Quote
+}
+
+func (o Options) maxLine() int {
+	if o.MaxLine <= 0 {
+		return DefaultMaxLine
+	}
+	return o.MaxLine
+}
+
+// header reports whether the first row is a header, which selecting the
+// sort field by name requires.
+func (o Options) header() bool {
+	return o.Header || o.FieldName != "" || o.HeadLines > 0
+}
+
+// HeaderRows is the number of rows on top that aren't sorted. The first
+// one names the fields.
+func (o Options) HeaderRows() int {
+	if o.HeadLines > 0 {
+		return o.HeadLines
+	}
+	if o.header() {
+		return 1
+	}
+	return 0
+}
+
+func (o Options) fields() []int {
+	if len(o.Fields) == 0 {
+		return []int{0}
+	}
+	return o.Fields
+}
+
+func (o Options) compare() compareFunc {
+	compare := strings.Compare
+	if o.Locale != "" {
+		// Validate checked the tag
+		compare, _ = compareLocale(o.Locale)
+	}
+	if o.Hash {
+		compare = compareHashes
+	} else if o.DateLayout != "" {
+		compare = compareDates(o.DateLayout)
+	} else if o.Month {
+		compare = compareMonths
+	} else if o.IP {
+		compare = compareIPs
+	} else if o.Numeric && (o.Thousands != "" || o.Units) {
+		compare = func(a, b string) int {
+			return compareParsed(a, b, o.number)
+		}
+	} else if o.Numeric {
+		compare = compareNumeric
+	} else if o.Version {
+		compare = compareVersions
+	} else if o.Natural {
+		compare = compareNatural
+	}
+	if o.IgnoreCase {
+		compare = ignoreCase(compare)
+	}
+	if o.ByLength {
+		compare = byLength(compare)
+	}
+	if o.Blanks || o.KeyStart > 0 || o.KeyEnd > 0 {
+		compare = byKey(compare, o.key)
+	}
+	return compare
+}
+
+// key is the part of the field that is compared, taken after the leading
+// blanks are dropped.
+func (o Options) key(field string) string {
+	if o.Blanks {
+		field = strings.TrimLeft(field, " \t")
+	}
+	end := len(field)
+	if o.KeyEnd > 0 {
+		end = min(o.KeyEnd, end)
+	}
+	return field[min(o.KeyStart, end):end]
+}
+
+// Sort reads delimited rows from r, sorts them as opts says and writes
+// them to w using the same delimiter.
+func Sort(r io.Reader, w io.Writer, opts Options) error {
+	rd, err := NewReader(r, opts)
+	if err != nil {
+		return err
+	}
+	// with the delimiter detected if it was auto
+	opts = rd.opts
+	var rerr error
+	next := func() ([]string, bool) {
+		row, err := rd.Next()
+		if err != nil {
+			if err != io.EOF {
+				rerr = err
+			}
+			return nil, false
+		}
+		return row, true
+	}
+	sorted, err := SortStream(next, opts)
+	if err != nil {
+		return err
+	}
+	defer sorted.Close()
+	if rerr != nil {
+		return rerr
+	}
+	return WriteRows(w, sorted, opts)
+}
+
+// RowReader is implemented by csv.Reader, splitReader and the readers the
+// sorting stages return. Read returns io.EOF after the last row.
+type RowReader interface {
+	Read() ([]string, error)
+}
+
+// Rows are the sorted rows SortRows and SortStream return. Close removes
+// the temporary files the merge sort keeps them in, so it has to be called
+// whether all the rows are read or not.
+type Rows struct {
+	RowReader
+	once  sync.Once
+	close func() error
+	err   error
+}
+
+// Close releases the rows. It is safe to call more than once, and from
+// another goroutine than the one reading them.
+func (r *Rows) Close() error {
+	r.once.Do(func() {
+		if r.close != nil {
+			r.err = r.close()
+		}
+	})
+	return r.err
+}
+
+// sliceReader reads rows from memory.
+type sliceReader struct {
+	rows [][]string
+}
+
+func (r *sliceReader) Read() ([]string, error) {
+	if len(r.rows) == 0 {
+		return nil, io.EOF
+	}
+	row := r.rows[0]
+	r.rows = r.rows[1:]
+	return row, nil
+}
+
+// multiReader reads the rows of each reader in turn.
+type multiReader struct {
+	readers []RowReader
+}
+
+func (r *multiReader) Read() ([]string, error) {
+	for len(r.readers) > 0 {
+		row, err := r.readers[0].Read()
+		if err != io.EOF {
+			return row, err
+		}
+		r.readers = r.readers[1:]
+	}
+	return nil, io.EOF
+}
+
+// lineReader is a RowReader that knows the line the last row started on.
+type lineReader interface {
+	RowReader
+	Line() int
+}
+
+// csvReader keeps track of lines for csv.Reader. The reader skips blank
+// lines on its own, so they are found from the gaps between records.
+type csvReader struct {
+	*csv.Reader
+	line      int
+	end       int // last line of the previous record
+	skipBlank bool
+	quote     byte
+	comments  map[int]bool // comment lines, which aren't blank
+}
+
+func (r *csvReader) Read() ([]string, error) {
+	row, err := r.Reader.Read()
+	if err != nil {
+		return row, err
+	}
+	r.line, _ = r.FieldPos(0)
+	for l := r.end + 1; l < r.line; l++ {
+		if !r.comments[l] && !r.skipBlank {
+			return nil, fmt.Errorf("line %d is blank", l)
+		}
+		delete(r.comments, l)
+	}
+	last, _ := r.FieldPos(len(row) - 1)
+	r.end = last + strings.Count(row[len(row)-1], "\n")
+	if r.quote != '"' {
+		for i := range row {
+			row[i] = swapQuote(row[i], r.quote)
+		}
+	}
+	return row, nil
+}
+
+// commentReader blanks out the lines starting with the comment, after any
+// spaces or tabs, and records their numbers. Lines inside quoted fields are
+// kept, so the quote must already be a double quote.
+type commentReader struct {
+	r        io.Reader
+	comment  byte
+	comments map[int]bool
+	line     int
+	start    bool   // at the start of a line
+	pending  []byte // spaces and tabs at the start of the line
+	skip     bool   // in a comment
+	quoted   bool
+	in, out  []byte
+}
+
+func newCommentReader(r io.Reader, comment byte) *commentReader {
+	return &commentReader{r: r, comment: comment, comments: map[int]bool{}, line: 1, start: true, in: make([]byte, 4096)}
+}
+
+func (c *commentReader) Read(p []byte) (int, error) {
+	for len(c.out) == 0 {
+		n, err := c.r.Read(c.in)
+		for _, b := range c.in[:n] {
+			c.filter(b)
+		}
+		if err != nil {
+			if len(c.out) == 0 {
+				c.out = append(c.out, c.pending...)
+				c.pending = nil
+			}
+			if len(c.out) == 0 {
+				return 0, err
+			}
+			break
+		}
+	}
+	n := copy(p, c.out)
+	c.out = c.out[n:]
+	return n, nil
+}
+
+func (c *commentReader) filter(b byte) {
+	switch {
+	case c.skip:
+		if b == '\n' {
+			c.out = append(c.out, b)
+			c.line++
+			c.skip, c.start = false, true
+		}
+		return
+	case c.start && (b == ' ' || b == '\t'):
+		c.pending = append(c.pending, b)
+		return
+	case c.start && b == c.comment:
+		c.comments[c.line] = true
+		c.pending, c.skip = c.pending[:0], true
+		return
+	case c.start:
+		c.out = append(c.out, c.pending...)
+		c.pending, c.start = c.pending[:0], false
+	}
+	c.out = append(c.out, b)
+	if b == '"' {
+		c.quoted = !c.quoted
+	} else if b == '\n' {
+		c.line++
+		c.start = !c.quoted
+	}
+}
+
+// quoteReader swaps the quote with double quotes, the only ones
+// encoding/csv knows. The fields it reads are swapped back.
+type quoteReader struct {
+	r     io.Reader
+	quote byte
+}
+
+func (q *quoteReader) Read(p []byte) (int, error) {
+	n, err := q.r.Read(p)
+	swapQuoteBytes(p[:n], q.quote)
+	return n, err
+}
+
+func swapQuoteBytes(p []byte, quote byte) {
+	for i, c := range p {
+		if c == quote {
+			p[i] = '"'
+		} else if c == '"' {
+			p[i] = quote
+		}
+	}
+}
+
+func swapQuote(s string, quote byte) string {
+	if !strings.ContainsAny(s, string([]byte{'"', quote})) {
+		return s
+	}
+	b := []byte(s)
+	swapQuoteBytes(b, quote)
+	return string(b)
+}
+
+func (r *csvReader) Line() int {
+	return r.line
+}
+
+// splitReader splits lines on a multi-character delimiter, which
+// encoding/csv can't handle, or at fixed widths. Quoting isn't supported
+// in this mode.
+type splitReader struct {
+	s         *bufio.Scanner
+	delim     string
+	widths    []int
+	line      int
+	maxLine   int
+	skipBlank bool
+	comment   string
+}
+
+func (r *splitReader) Read() ([]string, error) {
+	blank := 0
+	for r.s.Scan() {
+		r.line++
+		line := r.s.Text()
+		if r.comment != "" && strings.HasPrefix(strings.TrimLeft(line, " \t"), r.comment) {
+			continue
+		}
+		if line == "" {
+			// like encoding/csv, allow blank lines at the end of the input
+			if blank == 0 {
+				blank = r.line
+			}
+			continue
+		}
+		if blank != 0 && !r.skipBlank {
+			return nil, fmt.Errorf("line %d is blank", blank)
+		}
+		if r.widths != nil {
+			return splitWidths(line, r.widths), nil
+		}
+		return strings.Split(line, r.delim), nil
+	}
+	if r.s.Err() == bufio.ErrTooLong {
+		return nil, fmt.Errorf("line %d is longer than the maximum of %d bytes", r.line+1, r.maxLine)
+	}
+	if r.s.Err() != nil {
+		return nil, r.s.Err()
+	}
+	return nil, io.EOF
+}
+
+func (r *splitReader) Line() int {
+	return r.line
+}
+
+// splitWidths cuts the line into fields of the widths with the padding
+// around them removed. Fields past the end of a short line are empty and
+// the last field runs to the end of a long one.
+func splitWidths(line string, widths []int) []string {
+	row := make([]string, len(widths))
+	start := 0
+	for i, w := range widths {
+		end := min(start+w, len(line))
+		if i == len(widths)-1 {
+			end = len(line)
+		}
+		if start < end {
+			row[i] = strings.TrimSpace(line[start:end])
+		}
+		start = end
+	}
+	return row
+}
+
+func newRowReader(readfrom io.Reader, opts Options) lineReader {
+	delim := opts.delimiter()
+	comma, ok := singleRune(delim)
+	if !ok || opts.Widths != nil {
+		s := bufio.NewScanner(readfrom)
+		// leave room for the line break after the longest line allowed
+		s.Buffer(make([]byte, 0, bufio.MaxScanTokenSize), opts.maxLine()+2)
+		r := &splitReader{s: s, delim: delim, widths: opts.Widths, maxLine: opts.maxLine(), skipBlank: opts.SkipBlank}
+		if opts.Comment != 0 {
+			r.comment = string(opts.Comment)
+		}
+		return r
+	}
+	quote := byte(opts.quote())
+	comment := byte(opts.Comment)
+	if quote != '"' {
+		readfrom = &quoteReader{r: readfrom, quote: quote}
+		if comment == '"' {
+			comment = quote
+		}
+	}
+	var comments map[int]bool
+	if comment != 0 {
+		cr := newCommentReader(readfrom, comment)
+		readfrom, comments = cr, cr.comments
+	}
+	r := csv.NewReader(readfrom)
+	r.Comma = comma
+	r.FieldsPerRecord = -1
+	return &csvReader{Reader: r, skipBlank: opts.SkipBlank, quote: quote, comments: comments}
+}
+
+// detectDelimiter peeks at the first lines of r and picks the candidate
+// found the same number of times on each of them, the most frequent one if
+// several are. It returns a comma and false if no single candidate wins.
+// Comment lines and quoted fields are passed over as opts says.
+func detectDelimiter(r *bufio.Reader, opts Options) (string, bool) {
+	buf, _ := r.Peek(r.Size())
+	lines := strings.Split(string(buf), "\n")
+	if len(lines) > 1 && len(buf) == r.Size() {
+		// the last line may be cut short
+		lines = lines[:len(lines)-1]
+	}
+	best, bestCount, tie := "", 0, false
+	for _, delim := range delimiterCandidates {
+		count, consistent, checked := -1, true, 0
+		for _, line := range lines {
+			line = strings.TrimSuffix(line, "\r")
+			if line == "" || (opts.Comment != 0 && strings.HasPrefix(strings.TrimLeft(line, " \t"), string(opts.Comment))) {
+				continue
+			}
+			if checked == 5 {
+				break
+			}
+			checked++
+			n := countUnquoted(line, delim, byte(opts.quote()))
+			if count == -1 {
+				count = n
+			} else if n != count {
+				consistent = false
+				break
+			}
+		}
+		if !consistent || count <= 0 {
+			continue
+		}
+		if count > bestCount {
+			best, bestCount, tie = delim, count, false
+		} else if count == bestCount {
+			tie = true
+		}
+	}
+	if best == "" || tie {
+		return ",", false
+	}
+	return best, true
+}
+
+// countUnquoted counts delim in line outside quotes.
+func countUnquoted(line string, delim string, quote byte) int {
+	n, quoted := 0, false
+	for i := 0; i < len(line); i++ {
+		if line[i] == quote {
+			quoted = !quoted
+		} else if !quoted && strings.HasPrefix(line[i:], delim) {
+			n++
+		}
+	}
+	return n
+}
+
+// singleRune reports whether the delimiter is a single rune that
+// encoding/csv can use as a separator.
+func singleRune(delim string) (rune, bool) {
+	if utf8.RuneCountInString(delim) != 1 {
+		return 0, false
+	}
+	r, _ := utf8.DecodeRuneInString(delim)
+	return r, r != utf8.RuneError && r != '"' && r != '\r' && r != '\n'
+}
+
+// Reader reads rows one at a time the way Sort does, without sorting them.
+type Reader struct {
+	r     lineReader
+	opts  Options
+	n     int   // columns of the first row
+	rows  int   // rows read
+	guess bool  // the delimiter is the comma detecting it fell back to
+	keys  []int // sort fields checked to be numbers for Reject
+}
+
+// NewReader returns a Reader of the rows in r, read with the delimiter,
+// quote, encoding and the other options opts has for the input.
+func NewReader(r io.Reader, opts Options) (*Reader, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	r = decodeInput(r, opts.Encoding)
+	if opts.Delimiter == AutoDelimiter {
+		br := bufio.NewReader(r)
+		var ok bool
+		opts.Delimiter, ok = detectDelimiter(br, opts)
+		rd := newReader(br, opts)
+		rd.guess = !ok
+		return rd, nil
+	}
+	return newReader(r, opts), nil
+}
+
+// Delimiter returns the delimiter the rows are read with. With an auto
+// delimiter it reports false if none was found and a comma is used.
+func (r *Reader) Delimiter() (string, bool) {
+	return r.opts.delimiter(), !r.guess
+}
+
+func newReader(r io.Reader, opts Options) *Reader {
+	return &Reader{r: newRowReader(r, opts), opts: opts}
+}
+
+// Next returns the next row, or io.EOF after the last one. Rows with the
+// wrong number of columns go to Reject if it is set, and are skipped.
+func (r *Reader) Next() ([]string, error) {
+	for {
+		row, err := r.r.Read()
+		if err != nil {
+			return nil, err
+		}
+		if rowLength(row, r.opts.delimiter()) > r.opts.maxLine() {
+			return nil, fmt.Errorf("line %d is longer than the maximum of %d bytes", r.r.Line(), r.opts.maxLine())
+		}
+		if r.opts.Trim {
+			for i := range row {
+				row[i] = strings.TrimSpace(row[i])
+			}
+		}
+		r.rows++
+		if err := r.check(row); err != nil {
+			if r.opts.Reject == nil {
+				return nil, err
+			}
+			r.opts.Reject(row, err)
+			continue
+		}
+		return row, nil
+	}
+}
+
+// check returns the error of a row with the wrong number of columns. With
+// Reject and Numeric set, a sort field that isn't a number is one too.
+func (r *Reader) check(row []string) error {
+	if r.n == 0 {
+		r.n = len(row)
+		if o := r.opts; o.Reject != nil && o.Numeric && o.resolveFields(row) == nil {
+			r.keys = o.fields()
+		}
+	}
+	if r.n != len(row) && !r.opts.Ragged {
+		return fmt.Errorf("line %d has %d columns, expected %d", r.r.Line(), len(row), r.n)
+	}
+	// a header, even one that AutoHeader is still to find, isn't a number
+	if r.rows <= r.opts.HeaderRows() || r.rows == 1 && r.opts.AutoHeader {
+		return nil
+	}
+	for _, f := range r.keys {
+		if f >= len(row) || r.opts.Nulls != "" && row[f] == r.opts.NullValue {
+			continue
+		}
+		if _, ok := r.opts.number(r.opts.key(row[f])); !ok {
+			return fmt.Errorf("line %d: field %d is not a number: %q", r.r.Line(), f, row[f])
+		}
+	}
+	return nil
+}
+
+// ReadAll reads the rest of the rows, padded with Ragged.
+func (r *Reader) ReadAll() (content [][]string, err error) {
+	for {
+		row, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		content = append(content, row)
+	}
+	if r.opts.Ragged {
+		padRows(content)
+	}
+	return content, nil
+}
+
+// padRows pads the rows with empty fields to the length of the longest.
+func padRows(rows [][]string) {
+	n := 0
+	for _, row := range rows {
+		n = max(n, len(row))
+	}
+	for i, row := range rows {
+		if len(row) < n {
+			rows[i] = append(row, make([]string, n-len(row))...)
+		}
+	}
+}
+
+// rowLength is the length of the row joined back with the delimiter,
+// without any quotes.
+func rowLength(row []string, delim string) int {
+	n := len(delim) * (len(row) - 1)
+	for _, field := range row {
+		n += len(field)
+	}
+	return n
+}
+
+// SortStream sorts the rows next returns until it returns false. With the
+// merge algorithm they are sorted as they come instead of all at once.
+func SortStream(next func() ([]string, bool), opts Options) (*Rows, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	next, opts = prepare(next, opts)
+	return algorithms[opts.algorithm()](next, opts)
+}
+
+// prepare returns the rows next returns that are to be sorted: a header is
+// detected first, then the rows past the Limit, outside From and To or not
+// matching the Filters are dropped. Sorting, checking and describing rows
+// all read them through it.
+func prepare(next func() ([]string, bool), opts Options) (func() ([]string, bool), Options) {
+	next, opts = detectHeader(next, opts)
+	next = limitNext(next, opts)
+	return filterNext(statsNext(rangeNext(next, opts), opts), opts), opts
+}
+
+// rowsNext returns the rows one at a time, like the reading stages do.
+func rowsNext(rows [][]string) func() ([]string, bool) {
+	return func() ([]string, bool) {
+		if len(rows) == 0 {
+			return nil, false
+		}
+		row := rows[0]
+		rows = rows[1:]
+		return row, true
+	}
+}
+
+// collect reads the rows next returns into memory.
+func collect(next func() ([]string, bool)) [][]string {
+	rows := [][]string{}
+	for row, ok := next(); ok; row, ok = next() {
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// statsNext adds the rows next returns to opts.Stats.
+func statsNext(next func() ([]string, bool), opts Options) func() ([]string, bool) {
+	st := opts.Stats
+	if st == nil {
+		return next
+	}
+	n, seen := 0, false
+	field, compare := opts.fields()[0], opts.compare()
+	return func() ([]string, bool) {
+		row, ok := next()
+		if !ok {
+			return nil, false
+		}
+		n++
+		if n == 1 {
+			st.Columns = len(row)
+			if f, err := fieldByName(row, opts.FieldName, opts.AllowDups); opts.FieldName != "" && err == nil {
+				field = f
+			} else if field < 0 {
+				field += len(row)
+			}
+		}
+		if n <= opts.HeaderRows() {
+			return row, true
+		}
+		st.Rows++
+		if field >= 0 && field < len(row) {
+			v := row[field]
+			if !seen || compare(v, st.Min) < 0 {
+				st.Min = v
+			}
+			if !seen || compare(v, st.Max) > 0 {
+				st.Max = v
+			}
+			seen = true
+		}
+		return row, true
+	}
+}
+
+// headerSample is the number of rows looksLikeHeader looks at.
+const headerSample = 20
+
+// detectHeader sets Header if the first rows next returns look like they
+// start with one. The rows it peeks at are returned by next all the same.
+func detectHeader(next func() ([]string, bool), opts Options) (func() ([]string, bool), Options) {
+	if !opts.AutoHeader || opts.header() {
+		return next, opts
+	}
+	sample := headerSample
+	if opts.Limit > 0 {
+		// the rows past the limit aren't read, even to look for a header
+		sample = min(sample, opts.HeaderRows()+opts.Limit)
+	}
+	var peeked [][]string
+	for len(peeked) < sample {
+		row, ok := next()
+		if !ok {
+			break
+		}
+		peeked = append(peeked, row)
+	}
+	opts.Header = looksLikeHeader(peeked)
+	return func() ([]string, bool) {
+		if len(peeked) > 0 {
+			row := peeked[0]
+			peeked = peeked[1:]
+			return row, true
+		}
+		return next()
+	}, opts
+}
+
+// looksLikeHeader reports whether no field of the first row is a number,
+// while some column has only numbers below it.
+func looksLikeHeader(rows [][]string) bool {
+	if len(rows) < 2 {
+		return false
+	}
+	for _, field := range rows[0] {
+		if _, ok := parseNumber(field); ok {
+			return false
+		}
+	}
+	for c := range rows[0] {
+		numeric := true
+		for _, row := range rows[1:] {
+			if c >= len(row) {
+				numeric = false
+				break
+			}
+			if _, ok := parseNumber(row[c]); !ok {
+				numeric = false
+				break
+			}
+		}
+		if numeric {
+			return true
+		}
+	}
+	return false
+}
+
+// limitNext returns only the header and the Limit rows after it. The rows
+// after them aren't read, so the reading can stop there.
+func limitNext(next func() ([]string, bool), opts Options) func() ([]string, bool) {
+	if opts.Limit == 0 {
+		return next
+	}
+	n := opts.HeaderRows() + opts.Limit
+	return func() ([]string, bool) {
+		if n == 0 {
+			return nil, false
+		}
+		n--
+		return next()
+	}
+}
+
+// rangeNext skips the rows before From and after To, but never the header.
+// The rows after To are still read, so the input is read to the end.
+func rangeNext(next func() ([]string, bool), opts Options) func() ([]string, bool) {
+	if opts.From == 0 && opts.To == 0 {
+		return next
+	}
+	n := -opts.HeaderRows()
+	return func() ([]string, bool) {
+		for {
+			row, ok := next()
+			if !ok {
+				return nil, false
+			}
+			n++
+			if n <= 0 || n >= opts.From && (opts.To == 0 || n <= opts.To) {
+				return row, true
+			}
+		}
+	}
+}
+
+// filterNext skips the rows that don't match the filters, but never the
+// header.
+func filterNext(next func() ([]string, bool), opts Options) func() ([]string, bool) {
+	if len(opts.Filters) == 0 {
+		return next
+	}
+	n := 0
+	return func() ([]string, bool) {
+		for {
+			row, ok := next()
+			if !ok {
+				return nil, false
+			}
+			n++
+			if n <= opts.HeaderRows() || opts.keep(row) {
+				return row, true
+			}
+		}
+	}
+}
+
+// SortRows sorts the rows, which are read the way SortStream reads them.
+func SortRows(buff [][]string, opts Options) (*Rows, error) {
+	return SortStream(rowsNext(buff), opts)
+}
+
+// sortRows sorts the rows prepare returned in memory with sortData.
+func sortRows(buff [][]string, sortData sortFunc, opts Options) (*Rows, error) {
+	if opts.Ragged {
+		// rows from different inputs may still differ
+		padRows(buff)
+	}
+	if opts.Transpose {
+		var err error
+		if buff, err = transpose(buff); err != nil {
+			return nil, err
+		}
+	}
+	if len(buff) > 0 {
+		if err := opts.resolveFields(buff[0]); err != nil {
+			return nil, err
+		}
+	}
+	h := opts.HeaderRows()
+	if len(buff) <= h {
+		// nothing to sort, only the header (if any) is left
+		return &Rows{RowReader: &sliceReader{rows: buff}}, nil
+	}
+	compareRows := opts.byFields()
+	head, data := buff[:h], buff[h:]
+	if opts.Shuffle {
+		rand.New(rand.NewSource(opts.Seed)).Shuffle(len(data), func(i, j int) {
+			data[i], data[j] = data[j], data[i]
+		})
+		return &Rows{RowReader: finishRows(head, &sliceReader{rows: data}, compareRows, opts)}, nil
+	}
+	data = sortData(data, compareRows, opts)
+	return &Rows{RowReader: finishRows(head, &sliceReader{rows: data}, compareRows, opts)}, nil
+}
+
+// transpose turns the columns of rows into rows.
+func transpose(rows [][]string) ([][]string, error) {
+	if len(rows) == 0 {
+		return rows, nil
+	}
+	t := make([][]string, len(rows[0]))
+	for i := range t {
+		t[i] = make([]string, len(rows))
+	}
+	for j, row := range rows {
+		if len(row) != len(t) {
+			return nil, fmt.Errorf("row %d has %d columns, expected %d", j+1, len(row), len(t))
+		}
+		for i, field := range row {
+			t[i][j] = field
+		}
+	}
+	return t, nil
+}
+
+// algorithm sorts the rows next returns, which prepare picked already.
+// It takes the rows one at a time, so that the external merge sort can
+// sort more than fits in memory, and the Options, since a row is compared
+// by several fields, each in its own order and way.
+type algorithm func(next func() ([]string, bool), opts Options) (*Rows, error)
+
+// sortFunc sorts the data rows by compareRows in the order opts asks for.
+type sortFunc func(data [][]string, compareRows func(a, b []string) int, opts Options) [][]string
+
+// inMemory is the algorithm reading all the rows and sorting them with
+// sortData.
+func inMemory(sortData sortFunc) algorithm {
+	return func(next func() ([]string, bool), opts Options) (*Rows, error) {
+		return sortRows(collect(next), sortData, opts)
+	}
+}
+
+// mergeAlgorithm names the external merge sort, which can't take some of
+// the options the sorts in memory take.
+const mergeAlgorithm = "merge"
+
+// algorithms are the sorts by their Options.Algorithm names.
+var algorithms = map[string]algorithm{
+	"builtin":      inMemory(builtinSort),
+	"tree":         inMemory(treeSort),
+	mergeAlgorithm: externalSort,
+}
+
+// Algorithms lists the names of all the algorithms in order.
+func Algorithms() []string {
+	var names []string
+	for name := range algorithms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func builtinSort(data [][]string, compareRows func(a, b []string) int, opts Options) [][]string {
+	sortSlice := sort.Slice
+	if opts.Stable || opts.IgnoreCase {
+		// values equal ignoring case keep their input order
+		sortSlice = sort.SliceStable
+	}
+	less := lessFunc(compareRows, opts.Order)
+	if opts.Parallel {
+		parallelSort(data, less, runtime.GOMAXPROCS(0))
+		return data
+	}
+	sortSlice(data, func(i, j int) bool {
+		return less(data[i], data[j])
+	})
+	return data
+}
+
+func treeSort(data [][]string, compareRows func(a, b []string) int, opts Options) [][]string {
+	compare := compareRows
+	if opts.Order == Descending {
+		// reversing the order of the walk would reverse equal rows too
+		compare = func(a, b []string) int { return compareRows(b, a) }
+	}
+	t := &Tree{}
+	for _, row := range data {
+		t.insert(row, compare)
+	}
+	sorted := make([][]string, 0, len(data))
+	t.root.rewriteTree(&sorted)
+	return sorted
+}
+
+// parallelSort sorts n parts of data in their own goroutines, then merges
+// neighbouring parts, also in parallel, until they make up one. Ties keep
+// their input order since both steps are stable.
+func parallelSort(data [][]string, less func(a, b []string) bool, n int) {
+	size := (len(data) + n - 1) / n
+	var bounds []int // parts are data[bounds[i]:bounds[i+1]]
+	for start := 0; start < len(data); start += size {
+		bounds = append(bounds, start)
+	}
+	bounds = append(bounds, len(data))
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < len(bounds)-1; i++ {
+		part := data[bounds[i]:bounds[i+1]]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sort.SliceStable(part, func(i, j int) bool {
+				return less(part[i], part[j])
+			})
+		}()
+	}
+	wg.Wait()
+
+	buf := make([][]string, len(data))
+	for len(bounds) > 2 {
+		merged := []int{0}
+		for i := 0; i+1 < len(bounds)-1; i += 2 {
+			lo, mid, hi := bounds[i], bounds[i+1], bounds[i+2]
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				mergeParts(buf[lo:hi], data[lo:mid], data[mid:hi], less)
+				copy(data[lo:hi], buf[lo:hi])
+			}()
+			merged = append(merged, hi)
+		}
+		if len(bounds)%2 == 0 {
+			// an odd part out waits for the next round
+			merged = append(merged, len(data))
+		}
+		wg.Wait()
+		bounds = merged
+	}
+}
+
+// mergeParts merges the sorted a and b into out, taking from a on ties.
+func mergeParts(out, a, b [][]string, less func(a, b []string) bool) {
+	i, j := 0, 0
+	for k := range out {
+		if j == len(b) || (i < len(a) && !less(b[j], a[i])) {
+			out[k] = a[i]
+			i++
+		} else {
+			out[k] = b[j]
+			j++
+		}
+	}
+}
+
+// resolveFields looks up FieldName in the first row, counts negative
+// fields from its end and checks that the sort fields exist in it.
+func (o *Options) resolveFields(first []string) error {
+	if o.FieldName != "" {
+		f, err := fieldByName(first, o.FieldName, o.AllowDups)
+		if err != nil {
+			return err
+		}
+		o.Fields = []int{f}
+	}
+	resolve := func(list []int) ([]int, error) {
+		fields := make([]int, len(list))
+		for i, f := range list {
+			fields[i] = f
+			if f < 0 {
+				fields[i] += len(first)
+			}
+			if fields[i] < 0 || fields[i] >= len(first) {
+				return nil, fmt.Errorf("field %d out of range (file has %d columns)", f, len(first))
+			}
+		}
+		return fields, nil
+	}
+	var err error
+	if o.Fields, err = resolve(o.fields()); err != nil {
+		return err
+	}
+	if len(o.GroupBy) > 0 {
+		if o.GroupBy, err = resolve(o.GroupBy); err != nil {
+			return err
+		}
+	}
+	aggs := make([]Aggregate, len(o.Aggs))
+	for i, a := range o.Aggs {
+		f, err := resolve([]int{a.Field})
+		if err != nil {
+			return err
+		}
+		aggs[i] = Aggregate{Func: a.Func, Field: f[0]}
+	}
+	o.Aggs = aggs
+	for _, c := range o.Columns {
+		if c < 0 || c >= len(first) {
+			return fmt.Errorf("output column %d out of range (file has %d columns)", c, len(first))
+		}
+	}
+	return nil
+}
+
+// Report is what CheckRows found in the rows.
+type Report struct {
+	Rows     int      // rows checked, without the header
+	Columns  int      // columns of the first row
+	Problems []string // every problem found, in the order of the rows
+}
+
+// CheckRows validates the rows sorting would take from next the way
+// sorting them would and describes every problem found. Rows are numbered
+// from 1 and the header isn't counted.
+func CheckRows(next func() ([]string, bool), opts Options) Report {
+	next, opts = prepare(next, opts)
+	buff := collect(next)
+	if len(buff) == 0 {
+		return Report{}
+	}
+	h := min(opts.HeaderRows(), len(buff))
+	report := Report{Rows: len(buff) - h, Columns: len(buff[0])}
+	if err := opts.resolveFields(buff[0]); err != nil {
+		report.Problems = []string{err.Error()}
+		return report
+	}
+	for i, row := range buff[h:] {
+		if len(row) != len(buff[0]) {
+			report.Problems = append(report.Problems, fmt.Sprintf("row %d has %d columns, expected %d", i+1, len(row), len(buff[0])))
+			continue
+		}
+		if !opts.Numeric {
+			continue
+		}
+		for _, f := range opts.fields() {
+			if _, ok := opts.number(row[f]); !ok {
+				report.Problems = append(report.Problems, fmt.Sprintf("row %d: field %d is not a number: %q", i+1, f, row[f]))
+			}
+		}
+	}
+	return report
+}
+
+// Column describes the values a column has, without the header.
+type Column struct {
+	Name     string // header of the column or its field number
+	Numeric  bool   // whether every value that isn't null is a number
+	Min, Max string // smallest and largest value, as numbers if Numeric
+	Distinct int    // different values, nulls aside
+	Nulls    int    // values equal to NullValue
+}
+
+// DescribeRows returns the columns of the rows sorting would take from
+// next, as many as the first one has, named after the header if there is
+// one.
+func DescribeRows(next func() ([]string, bool), opts Options) []Column {
+	next, opts = prepare(next, opts)
+	buff := collect(next)
+	if len(buff) == 0 {
+		return nil
+	}
+	h := min(opts.HeaderRows(), len(buff))
+	cols := make([]Column, len(buff[0]))
+	for f := range cols {
+		col := &cols[f]
+		col.Name = strconv.Itoa(f)
+		if h > 0 {
+			col.Name = buff[0][f]
+		}
+		col.Numeric = true
+		var values []string
+		seen := map[string]bool{}
+		for _, row := range buff[h:] {
+			if f >= len(row) || row[f] == opts.NullValue {
+				col.Nulls++
+				continue
+			}
+			if _, ok := opts.number(row[f]); !ok {
+				col.Numeric = false
+			}
+			if !seen[row[f]] {
+				seen[row[f]] = true
+				values = append(values, row[f])
+			}
+		}
+		col.Distinct = len(values)
+		if len(values) == 0 {
+			col.Numeric = false
+			continue
+		}
+		col.Min, col.Max = values[0], values[0]
+		for _, v := range values[1:] {
+			if col.compare(v, col.Min, opts) < 0 {
+				col.Min = v
+			}
+			if col.compare(v, col.Max, opts) > 0 {
+				col.Max = v
+			}
+		}
+	}
+	return cols
+}
+
+// compare compares two values of the column, as numbers if it is Numeric.
+func (c Column) compare(a, b string, opts Options) int {
+	if !c.Numeric {
+		return strings.Compare(a, b)
+	}
+	x, _ := opts.number(a)
+	y, _ := opts.number(b)
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+// FirstUnsorted returns the number of the first row sorting would take
+// from next that sorts before the one above it, counting from 1 with the
+// header, or 0 if the rows are sorted. With Unique equal rows aren't
+// sorted either.
+func FirstUnsorted(next func() ([]string, bool), opts Options) (int, error) {
+	next, opts = prepare(next, opts)
+	var less func(a, b []string) bool
+	var compareRows func(a, b []string) int
+	var prev []string
+	n := 0
+	for row, ok := next(); ok; row, ok = next() {
+		n++
+		if n == 1 {
+			if err := opts.resolveFields(row); err != nil {
+				return 0, err
+			}
+			compareRows = opts.byFields()
+			less = lessFunc(compareRows, opts.Order)
+		}
+		if n <= opts.HeaderRows() {
+			continue
+		}
+		if prev != nil && (less(row, prev) || opts.Unique && compareRows(row, prev) == 0) {
+			return n, nil
+		}
+		prev = row
+	}
+	return 0, nil
+}
+
+// finishRows drops duplicates from the sorted data if asked to and puts the
+// header back on top of it.
+func finishRows(head [][]string, data RowReader, compareRows func(a, b []string) int, opts Options) RowReader {
+	if len(opts.GroupBy) > 0 {
+		group := opts
+		group.Fields, group.Orders, group.FieldName = opts.GroupBy, nil, ""
+		data = &groupReader{r: data, compare: group.byFields(), aggs: opts.Aggs, number: opts.number}
+	} else if opts.Unique || opts.Count {
+		u := &uniqueReader{r: data, compare: compareRows, count: opts.Count}
+		if opts.Stats != nil {
+			u.dropped = &opts.Stats.Duplicates
+		}
+		data = u
+	}
+	if opts.Head > 0 {
+		data = &headReader{r: data, n: opts.Head}
+	} else if opts.Tail > 0 {
+		data = &tailReader{r: data, n: opts.Tail}
+	}
+	if opts.Buckets > 0 {
+		// after any count, which is prefixed
+		field := opts.fields()[0]
+		if opts.Count {
+			field++
+		}
+		data = &bucketReader{r: data, field: field, n: uint64(opts.Buckets)}
+		for i := range head {
+			head[i] = append(head[i][:len(head[i]):len(head[i])], "bucket")
+		}
+	}
+	if opts.Count {
+		for i := range head {
+			head[i] = append([]string{"count"}, head[i]...)
+		}
+	}
+	// the header is never sorted and always goes first
+	var r RowReader = &multiReader{readers: []RowReader{&sliceReader{rows: head}, data}}
+	if len(opts.Columns) > 0 {
+		r = &projectReader{r: r, columns: opts.Columns, count: opts.Count, bucket: opts.Buckets > 0}
+	}
+	if opts.Number {
+		r = &numberReader{r: r, header: len(head)}
+	}
+	return r
+}
+
+// numberReader prefixes rows with their number, the header rows with
+// "number".
+type numberReader struct {
+	r      RowReader
+	header int
+	n      int
+}
+
+func (n *numberReader) Read() ([]string, error) {
+	row, err := n.r.Read()
+	if err != nil {
+		return nil, err
+	}
+	if n.header > 0 {
+		n.header--
+		return append([]string{"number"}, row...), nil
+	}
+	n.n++
+	return append([]string{strconv.Itoa(n.n)}, row...), nil
+}
+
+// headReader stops after the first n rows.
+type headReader struct {
+	r RowReader
+	n int
+}
+
+func (h *headReader) Read() ([]string, error) {
+	if h.n == 0 {
+		return nil, io.EOF
+	}
+	h.n--
+	return h.r.Read()
+}
+
+// tailReader returns only the last n rows, which it has to read everything
+// to find.
+type tailReader struct {
+	r    RowReader
+	n    int
+	rows *sliceReader
+}
+
+func (t *tailReader) Read() ([]string, error) {
+	if t.rows == nil {
+		last := make([][]string, 0, t.n)
+		for {
+			row, err := t.r.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if len(last) == t.n {
+				copy(last, last[1:])
+				last = last[:t.n-1]
+			}
+			last = append(last, row)
+		}
+		t.rows = &sliceReader{rows: last}
+	}
+	return t.rows.Read()
+}
+
+// projectReader keeps only the given columns of each row, in their order.
+// A count prefix stays in front and isn't counted as a column.
+type projectReader struct {
+	r       RowReader
+	columns []int
+	count   bool
+	bucket  bool
+}
+
+func (p *projectReader) Read() ([]string, error) {
+	row, err := p.r.Read()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]string, 0, len(p.columns)+1)
+	if p.count {
+		out = append(out, row[0])
+		row = row[1:]
+	}
+	for _, c := range p.columns {
+		out = append(out, row[c])
+	}
+	if p.bucket {
+		out = append(out, row[len(row)-1])
+	}
+	return out, nil
+}
+
+// groupReader returns the first row of each run of sorted rows that the
+// group fields compare equal in, with the aggregated fields set.
+type groupReader struct {
+	r       RowReader
+	compare func(a, b []string) int
+	aggs    []Aggregate
+	number  func(string) (float64, bool)
+	next    []string // the first row of the next group
+	done    bool
+}
+
+func (g *groupReader) Read() ([]string, error) {
+	if g.next == nil {
+		if g.done {
+			return nil, io.EOF
+		}
+		row, err := g.r.Read()
+		if err != nil {
+			return nil, err
+		}
+		g.next = row
+	}
+	group := [][]string{g.next}
+	g.next = nil
+	for {
+		row, err := g.r.Read()
+		if err == io.EOF {
+			g.done = true
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if g.compare(row, group[0]) != 0 {
+			g.next = row
+			break
+		}
+		group = append(group, row)
+	}
+	return g.aggregate(group)
+}
+
+func (g *groupReader) aggregate(group [][]string) ([]string, error) {
+	out := append([]string(nil), group[0]...)
+	for _, a := range g.aggs {
+		switch a.Func {
+		case "count":
+			out[a.Field] = strconv.Itoa(len(group))
+		case "first":
+			out[a.Field] = group[0][a.Field]
+		case "last":
+			out[a.Field] = group[len(group)-1][a.Field]
+		case "sum":
+			sum := 0.0
+			for _, row := range group {
+				v, ok := g.number(row[a.Field])
+				if !ok {
+					return nil, fmt.Errorf("field %d is not a number: %q", a.Field, row[a.Field])
+				}
+				sum += v
+			}
+			out[a.Field] = strconv.FormatFloat(sum, 'f', -1, 64)
+		}
+	}
+	return out, nil
+}
+
+// bucketReader adds a column with the hash of the field modulo n.
+type bucketReader struct {
+	r     RowReader
+	field int
+	n     uint64
+}
+
+func (b *bucketReader) Read() ([]string, error) {
+	row, err := b.r.Read()
+	if err != nil {
+		return nil, err
+	}
+	bucket := strconv.FormatUint(fnvHash(row[b.field])%b.n, 10)
+	return append(row[:len(row):len(row)], bucket), nil
+}
+
+func lessFunc(compareRows func(a, b []string) int, order Order) func(a, b []string) bool {
+	if order == Descending {
+		return func(a, b []string) bool { return compareRows(a, b) > 0 }
+	}
+	return func(a, b []string) bool { return compareRows(a, b) < 0 }
+}
+
+// fieldByName looks the name up in the header row. A name used by more
+// than one column is an error, as the field would be ambiguous, unless
+// allowDups takes the first of them.
+func fieldByName(header []string, name string, allowDups bool) (int, error) {
+	index := make(map[string]int, len(header))
+	for i, h := range header {
+		if _, ok := index[h]; ok {
+			if !allowDups {
+				return 0, fmt.Errorf("column name %q is used more than once in the header", h)
+			}
+			continue
+		}
+		index[h] = i
+	}
+	if i, ok := index[name]; ok {
+		return i, nil
+	}
+	return 0, fmt.Errorf("no column named %q, available columns: %s", name, strings.Join(header, ", "))
+}
+
+// uniqueReader drops repeated rows from sorted rows and, if count is set,
+// prefixes each remaining row with the number of its occurrences.
+// Identical rows always compare as equal, but rows with equal keys may
+// differ in other columns and sit between them, so every run of equal keys
+// is read and checked as a whole.
+type uniqueReader struct {
+	r       RowReader
+	compare func(a, b []string) int
+	count   bool
+	group   [][]string // rows of the current run left to return
+	next    []string   // first row of the next run
+	dropped *int       // repeated rows dropped so far, if not nil
+}
+
+func (u *uniqueReader) Read() ([]string, error) {
+	if len(u.group) == 0 {
+		if err := u.readGroup(); err != nil {
+			return nil, err
+		}
+	}
+	row := u.group[0]
+	u.group = u.group[1:]
+	return row, nil
+}
+
+func (u *uniqueReader) readGroup() error {
+	first := u.next
+	if first == nil {
+		row, err := u.r.Read()
+		if err != nil {
+			return err
+		}
+		first = row
+	}
+	u.next = nil
+	group := [][]string{first}
+	for {
+		row, err := u.r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if u.compare(first, row) != 0 {
+			u.next = row
+			break
+		}
+		group = append(group, row)
+	}
+
+	counts := []int{}
+	seen := map[string]int{}
+	for _, row := range group {
+		key := strings.Join(row, "\x00")
+		if i, ok := seen[key]; ok {
+			counts[i]++
+			if u.dropped != nil {
+				*u.dropped++
+			}
+			continue
+		}
+		seen[key] = len(u.group)
+		u.group = append(u.group, row)
+		counts = append(counts, 1)
+	}
+	if u.count {
+		for i, row := range u.group {
+			u.group[i] = append([]string{strconv.Itoa(counts[i])}, row...)
+		}
+	}
+	return nil
+}
+
+// compareFunc compares two sort field values and returns a negative number,
+// zero or a positive number like strings.Compare does.
+type compareFunc func(a, b string) int
+
+// compareNumeric compares values as float64. Values that aren't numbers
+// go before any number and are compared as strings between themselves.
+func compareNumeric(a, b string) int {
+	return compareParsed(a, b, parseNumber)
+}
+
+// compareParsed is compareNumeric with the numbers parsed by parse.
+func compareParsed(a, b string, parse func(string) (float64, bool)) int {
+	x, okA := parse(a)
+	y, okB := parse(b)
+	switch {
+	case !okA && !okB:
+		return strings.Compare(a, b)
+	case !okA:
+		return -1
+	case !okB:
+		return 1
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+// number parses s as a number without the thousands separators and, with
+// Units, multiplied by the K, M or G after it.
+func (o Options) number(s string) (float64, bool) {
+	if o.Thousands != "" {
+		s = strings.ReplaceAll(s, o.Thousands, "")
+	}
+	mult := 1.0
+	if o.Units && s != "" {
+		switch s[len(s)-1] {
+		case 'k', 'K':
+			mult = 1e3
+		case 'M':
+			mult = 1e6
+		case 'G':
+			mult = 1e9
+		}
+		if mult != 1 {
+			s = s[:len(s)-1]
+		}
+	}
+	x, ok := parseNumber(s)
+	return x * mult, ok
+}
+
+func parseNumber(s string) (float64, bool) {
+	x, err := strconv.ParseFloat(s, 64)
+	return x, err == nil && !math.IsNaN(x)
+}
+
+// compareDates compares values as times in the layout. Like with numbers,
+// values that don't parse go first.
+func compareDates(layout string) compareFunc {
+	return func(a, b string) int {
+		x, errA := time.Parse(layout, a)
+		y, errB := time.Parse(layout, b)
+		switch {
+		case errA != nil && errB != nil:
+			return strings.Compare(a, b)
+		case errA != nil:
+			return -1
+		case errB != nil:
+			return 1
+		}
+		return x.Compare(y)
+	}
+}
+
+// compareIPs compares IP addresses by their 16 byte form, which puts IPv4
+// addresses with the IPv4-mapped IPv6 ones. Like with numbers, values that
+// aren't addresses go first.
+func compareIPs(a, b string) int {
+	x, y := net.ParseIP(strings.TrimSpace(a)), net.ParseIP(strings.TrimSpace(b))
+	switch {
+	case x == nil && y == nil:
+		return strings.Compare(a, b)
+	case x == nil:
+		return -1
+	case y == nil:
+		return 1
+	}
+	if c := bytes.Compare(x.To16(), y.To16()); c != 0 {
+		return c
+	}
+	return strings.Compare(a, b)
+}
+
+// compareHashes compares the FNV-1a hashes of the values, and values with
+// the same hash as text.
+func compareHashes(a, b string) int {
+	if ha, hb := fnvHash(a), fnvHash(b); ha != hb {
+		if ha < hb {
+			return -1
+		}
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+func fnvHash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()
+}
+
+// compareMonths compares month names in the order of the months. Values
+// that aren't month names go before January.
+func compareMonths(a, b string) int {
+	if c := parseMonth(a) - parseMonth(b); c != 0 {
+		return c
+	}
+	return strings.Compare(a, b)
+}
+
+// parseMonth returns the number of the month named by s ignoring case,
+// or 0 if s isn't the name of a month or the first three letters of one.
+func parseMonth(s string) int {
+	s = strings.ToLower(strings.TrimSpace(s))
+	for m := time.January; m <= time.December; m++ {
+		name := strings.ToLower(m.String())
+		if s == name || s == name[:3] {
+			return int(m)
+		}
+	}
+	return 0
+}
+
+// compareNatural compares values like people do, so that file2 goes before
+// file10: runs of digits are compared by their numeric value and the rest
+// byte by byte. Values that differ only in leading zeros are compared as
+// strings to keep the order total.
+func compareNatural(a, b string) int {
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if isDigit(a[i]) && isDigit(b[j]) {
+			si, sj := i, j
+			for i < len(a) && isDigit(a[i]) {
+				i++
+			}
+			for j < len(b) && isDigit(b[j]) {
+				j++
+			}
+			x := strings.TrimLeft(a[si:i], "0")
+			y := strings.TrimLeft(b[sj:j], "0")
+			if len(x) != len(y) {
+				if len(x) < len(y) {
+					return -1
+				}
+				return 1
+			}
+			if c := strings.Compare(x, y); c != 0 {
+				return c
+			}
+			continue
+		}
+		if a[i] != b[j] {
+			if a[i] < b[j] {
+				return -1
+			}
+			return 1
+		}
+		i++
+		j++
+	}
+	switch {
+	case i < len(a):
+		return 1
+	case j < len(b):
+		return -1
+	}
+	return strings.Compare(a, b)
+}
+
+// compareVersions compares versions like 1.2.10 part by part, each like
+// compareNatural does, so 1.2.9 goes before 1.2.10. Missing parts count as
+// 0, but 1.2 still goes before 1.2.0 to keep the order total.
+func compareVersions(a, b string) int {
+	x, y := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < max(len(x), len(y)); i++ {
+		p, q := "0", "0"
+		if i < len(x) {
+			p = x[i]
+		}
+		if i < len(y) {
+			q = y[i]
+		}
+		if c := compareNatural(p, q); c != 0 {
+			return c
+		}
+	}
+	return strings.Compare(a, b)
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+// ignoreCase makes compare treat values that differ only in case as equal.
+func ignoreCase(compare compareFunc) compareFunc {
+	return func(a, b string) int {
+		return compare(strings.ToLower(a), strings.ToLower(b))
+	}
+}
+
+// byLength makes shorter values go first, comparing values of the same
+// length with compare.
+func byLength(compare compareFunc) compareFunc {
+	return func(a, b string) int {
+		if c := utf8.RuneCountInString(a) - utf8.RuneCountInString(b); c != 0 {
+			return c
+		}
+		return compare(a, b)
+	}
+}
+
+func byKey(compare compareFunc, key func(string) string) compareFunc {
+	return func(a, b string) int {
+		return compare(key(a), key(b))
+	}
+}
+
+// byFields compares rows by each of the sort fields in turn, moving to the
+// next field only when the previous ones are equal. Fields with a
+// Descending order compare the other way round. With Nulls set, a field equal to NullValue
+// goes first or last whatever the order.
+func (o Options) byFields() func(a, b []string) int {
+	fields, compare := o.fields(), o.compare()
+	return func(a, b []string) int {
+		for i, f := range fields {
+			if o.Nulls != "" {
+				nullA, nullB := a[f] == o.NullValue, b[f] == o.NullValue
+				if nullA && nullB {
+					continue
+				}
+				if nullA != nullB {
+					c := 1
+					if nullA == (o.Nulls == "first") {
+						c = -1
+					}
+					if o.Order == Descending {
+						// lessFunc turns it back
+						c = -c
+					}
+					return c
+				}
+			}
+			if c := compare(a[f], b[f]); c != 0 {
+				if i < len(o.Orders) && o.Orders[i] == Descending {
+					return -c
+				}
+				return c
+			}
+		}
+		return 0
+	}
+}
+
+func (t *Tree) insert(data []string, compare func(a, b []string) int) *Tree {
+	t.root = t.root.insert(data, compare)
+	return t
+}
+
+// insert adds data to the subtree and returns its new root. The tree is
+// kept balanced as an AVL tree, so sorted input doesn't turn it into a list.
+// Data equal to a node goes to its right, after it, and rotations keep the
+// order, so equal rows stay in the order they were inserted.
+func (n *Node) insert(data []string, compare func(a, b []string) int) *Node {
+	if n == nil {
+		return &Node{data: data, height: 1}
+	} else if compare(data, n.data) < 0 {
+		n.left = n.left.insert(data, compare)
+	} else {
+		n.right = n.right.insert(data, compare)
+	}
+	return n.balance()
+}
+
+func height(n *Node) int {
+	if n == nil {
+		return 0
+	}
+	return n.height
+}
+
+func (n *Node) update() {
+	n.height = 1 + max(height(n.left), height(n.right))
+}
+
+// balance rotates the subtree if one side got two levels deeper than the
+// other and returns its new root.
+func (n *Node) balance() *Node {
+	n.update()
+	switch d := height(n.left) - height(n.right); {
+	case d > 1:
+		if height(n.left.left) < height(n.left.right) {
+			n.left = n.left.rotateLeft()
+		}
+		return n.rotateRight()
+	case d < -1:
+		if height(n.right.right) < height(n.right.left) {
+			n.right = n.right.rotateRight()
+		}
+		return n.rotateLeft()
+	}
+	return n
+}
+
+func (n *Node) rotateRight() *Node {
+	l := n.left
+	n.left, l.right = l.right, n
+	n.update()
+	l.update()
+	return l
+}
+
+func (n *Node) rotateLeft() *Node {
+	r := n.right
+	n.right, r.left = r.left, n
+	n.update()
+	r.update()
+	return r
+}
+
+// rewriteTree appends the rows of the subtree to sorted in order.
+func (node *Node) rewriteTree(sorted *[][]string) {
+	if node == nil {
+		return
+	}
+	node.left.rewriteTree(sorted)
+	*sorted = append(*sorted, node.data)
+	node.right.rewriteTree(sorted)
+}
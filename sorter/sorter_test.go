@@ -0,0 +1,2150 @@
+package sorter
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// sortString sorts the rows of in with Sort and returns what it wrote.
+func sortString(t *testing.T, in string, opts Options) string {
+	t.Helper()
+	out, err := trySort(in, opts)
+	if err != nil {
+		t.Fatalf("Sort(%q): %v", in, err)
+	}
+	return out
+}
+
+// trySort is sortString returning the error of Sort.
+func trySort(in string, opts Options) (string, error) {
+	var out strings.Builder
+	err := Sort(strings.NewReader(in), &out, opts)
+	return out.String(), err
+}
+
+// readString reads all the rows of in with a Reader.
+func readString(t *testing.T, in string, opts Options) [][]string {
+	t.Helper()
+	rd, err := NewReader(strings.NewReader(in), opts)
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+	rows, err := rd.ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll(%q): %v", in, err)
+	}
+	return rows
+}
+
+func TestTreeSortMatchesBuiltin(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"three rows", "b,2\nc,3\na,1\n", "a,1\nb,2\nc,3\n"},
+		{"one row", "a,1\n", "a,1\n"},
+		{"empty", "", ""},
+		{"equal keys", "b,1\na,2\nb,3\na,4\n", "a,2\na,4\nb,1\nb,3\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tree := sortString(t, tt.in, Options{Algorithm: "tree"})
+			builtin := sortString(t, tt.in, Options{Algorithm: "builtin", Stable: true})
+			if tree != tt.want {
+				t.Errorf("tree sort = %q, want %q", tree, tt.want)
+			}
+			if tree != builtin {
+				t.Errorf("tree sort = %q, built in sort = %q", tree, builtin)
+			}
+		})
+	}
+}
+
+func TestTreeSortOrder(t *testing.T) {
+	const in = "b,1\nd,2\na,3\nc,4\nb,5\n"
+	tests := []struct {
+		name  string
+		order Order
+		want  string
+	}{
+		{"ascending", Ascending, "a,3\nb,1\nb,5\nc,4\nd,2\n"},
+		{"descending", Descending, "d,2\nc,4\nb,1\nb,5\na,3\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tree := sortString(t, in, Options{Algorithm: "tree", Order: tt.order})
+			if tree != tt.want {
+				t.Errorf("tree sort = %q, want %q", tree, tt.want)
+			}
+			builtin := sortString(t, in, Options{Order: tt.order, Stable: true})
+			if tree != builtin {
+				t.Errorf("tree sort = %q, built in sort = %q", tree, builtin)
+			}
+		})
+	}
+}
+
+func TestSortRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		opts Options
+		want [][]string
+	}{
+		{"plain", "b,2\na,1\n", Options{}, [][]string{{"a", "1"}, {"b", "2"}}},
+		{"by second field", "a,2\nb,1\n", Options{Fields: []int{1}}, [][]string{{"b", "1"}, {"a", "2"}}},
+		{"semicolons", "b;2\na;1\n", Options{Delimiter: ";"}, [][]string{{"a", "1"}, {"b", "2"}}},
+		{"one column", "b\na\n", Options{}, [][]string{{"a"}, {"b"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := sortString(t, tt.in, tt.opts)
+			if got := readString(t, out, tt.opts); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("rows read back from %q = %q, want %q", out, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDelimiter(t *testing.T) {
+	tests := []struct {
+		name, in, delim, want string
+	}{
+		{"semicolon", "b;1\na;2\n", ";", "a;2\nb;1\n"},
+		{"tab", "b\t1\na\t2\n", "\t", "a\t2\nb\t1\n"},
+		{"several characters", "b||1\na||2\n", "||", "a||2\nb||1\n"},
+		{"one column", "b\na\n", ";", "a\nb\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sortString(t, tt.in, Options{Delimiter: tt.delim}); got != tt.want {
+				t.Errorf("Sort = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQuotedFields(t *testing.T) {
+	tests := []struct {
+		name, in string
+		rows     [][]string
+		out      string
+	}{
+		{
+			"embedded comma",
+			"\"Smith, John\",42\nAdams,7\n",
+			[][]string{{"Smith, John", "42"}, {"Adams", "7"}},
+			"Adams,7\n\"Smith, John\",42\n",
+		},
+		{
+			"doubled quotes",
+			"\"say \"\"hi\"\"\",1\nb,2\n",
+			[][]string{{`say "hi"`, "1"}, {"b", "2"}},
+			"b,2\n\"say \"\"hi\"\"\",1\n",
+		},
+		{
+			"newline inside quotes",
+			"\"two\nlines\",1\na,2\n",
+			[][]string{{"two\nlines", "1"}, {"a", "2"}},
+			"a,2\n\"two\nlines\",1\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := readString(t, tt.in, Options{}); !reflect.DeepEqual(got, tt.rows) {
+				t.Errorf("rows = %q, want %q", got, tt.rows)
+			}
+			if got := sortString(t, tt.in, Options{}); got != tt.out {
+				t.Errorf("Sort = %q, want %q", got, tt.out)
+			}
+		})
+	}
+}
+
+func TestNumeric(t *testing.T) {
+	const in = "10\n9\nx\n2.5\n-1\n"
+	for _, algorithm := range Algorithms() {
+		t.Run(algorithm, func(t *testing.T) {
+			got := sortString(t, in, Options{Numeric: true, Algorithm: algorithm})
+			// the value that isn't a number goes before all the numbers
+			if want := "x\n-1\n2.5\n9\n10\n"; got != want {
+				t.Errorf("Sort = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestIgnoreCase(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"mixed case", "Banana\napple\nCherry\n", "apple\nBanana\nCherry\n"},
+		{"equal keep their order", "b\nApple\napple\nAPPLE\n", "Apple\napple\nAPPLE\nb\n"},
+	}
+	for _, tt := range tests {
+		for _, algorithm := range []string{"builtin", "tree"} {
+			t.Run(tt.name+"/"+algorithm, func(t *testing.T) {
+				if got := sortString(t, tt.in, Options{IgnoreCase: true, Algorithm: algorithm}); got != tt.want {
+					t.Errorf("Sort = %q, want %q", got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestMultipleFields(t *testing.T) {
+	const in = "b,2,x\na,1,z\nb,1,y\na,2,w\n"
+	tests := []struct {
+		name   string
+		fields []int
+		order  Order
+		want   string
+	}{
+		{"second field breaks ties", []int{0, 1}, Ascending, "a,1,z\na,2,w\nb,1,y\nb,2,x\n"},
+		{"reversed on every field", []int{0, 1}, Descending, "b,2,x\nb,1,y\na,2,w\na,1,z\n"},
+		{"third field first", []int{2, 0}, Ascending, "a,2,w\nb,2,x\nb,1,y\na,1,z\n"},
+	}
+	for _, tt := range tests {
+		for _, algorithm := range []string{"builtin", "tree"} {
+			t.Run(tt.name+"/"+algorithm, func(t *testing.T) {
+				got := sortString(t, in, Options{Fields: tt.fields, Order: tt.order, Algorithm: algorithm})
+				if got != tt.want {
+					t.Errorf("Sort = %q, want %q", got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestFieldOutOfRange(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields []int
+		want   string
+	}{
+		{"past the end", []int{5}, "field 5 out of range (file has 3 columns)"},
+		{"before the start", []int{-4}, "field -4 out of range (file has 3 columns)"},
+		{"tie breaker", []int{0, 3}, "field 3 out of range (file has 3 columns)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := trySort("a,b,c\nd,e,f\n", Options{Fields: tt.fields})
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("Sort error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestHeaderWithFewRows(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"empty", "", ""},
+		{"header only", "name,n\n", "name,n\n"},
+		{"one data row", "name,n\nb,1\n", "name,n\nb,1\n"},
+		{"two data rows", "name,n\nb,1\na,2\n", "name,n\na,2\nb,1\n"},
+	}
+	for _, tt := range tests {
+		for _, algorithm := range Algorithms() {
+			t.Run(tt.name+"/"+algorithm, func(t *testing.T) {
+				if got := sortString(t, tt.in, Options{Header: true, Algorithm: algorithm}); got != tt.want {
+					t.Errorf("Sort = %q, want %q", got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestUnique(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"exact duplicates", "b,1\na,2\nb,1\na,2\na,2\n", "a,2\nb,1\n"},
+		{"differing in another field", "a,1\na,2\na,1\n", "a,1\na,2\n"},
+		{"no duplicates", "c\nb\na\n", "a\nb\nc\n"},
+	}
+	for _, tt := range tests {
+		for _, algorithm := range Algorithms() {
+			t.Run(tt.name+"/"+algorithm, func(t *testing.T) {
+				if got := sortString(t, tt.in, Options{Unique: true, Algorithm: algorithm}); got != tt.want {
+					t.Errorf("Sort = %q, want %q", got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestCount(t *testing.T) {
+	tests := []struct {
+		name, in string
+		opts     Options
+		want     string
+	}{
+		{"mixed multiplicities", "b\na\nb\nc\nb\na\n", Options{}, "2,a\n3,b\n1,c\n"},
+		{"whole rows", "a,1\na,2\na,1\n", Options{}, "2,a,1\n1,a,2\n"},
+		{"other delimiter", "x;1\nx;1\n", Options{Delimiter: ";"}, "2;x;1\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.Count = true
+			if got := sortString(t, tt.in, tt.opts); got != tt.want {
+				t.Errorf("Sort = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHeaderStaysOnTop(t *testing.T) {
+	// the header would sort last, or first in reverse
+	const in = "zone,n\nb,1\na,2\n"
+	tests := []struct {
+		name  string
+		order Order
+		want  string
+	}{
+		{"ascending", Ascending, "zone,n\na,2\nb,1\n"},
+		{"descending", Descending, "zone,n\nb,1\na,2\n"},
+	}
+	for _, tt := range tests {
+		for _, algorithm := range Algorithms() {
+			t.Run(tt.name+"/"+algorithm, func(t *testing.T) {
+				got := sortString(t, in, Options{Header: true, Order: tt.order, Algorithm: algorithm})
+				if got != tt.want {
+					t.Errorf("Sort = %q, want %q", got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestStable(t *testing.T) {
+	// the built in sort.Slice reorders equal rows in slices this long
+	var in, want strings.Builder
+	for i := 0; i < 50; i++ {
+		fmt.Fprintf(&in, "%d,%d\n", i%2, i)
+	}
+	for _, key := range []int{0, 1} {
+		for i := key; i < 50; i += 2 {
+			fmt.Fprintf(&want, "%d,%d\n", key, i)
+		}
+	}
+	tests := []struct {
+		name string
+		opts Options
+	}{
+		{"stable", Options{Stable: true}},
+		{"tree", Options{Algorithm: "tree"}},
+		{"merge", Options{Algorithm: "merge", Chunk: 7}},
+		{"parallel", Options{Parallel: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sortString(t, in.String(), tt.opts); got != want.String() {
+				t.Errorf("Sort = %q, want %q", got, want.String())
+			}
+		})
+	}
+}
+
+func TestSortErrors(t *testing.T) {
+	tests := []struct {
+		name, in string
+		opts     Options
+		want     string
+	}{
+		{"column missing", "a,b\nc\n", Options{}, "line 2 has 1 columns, expected 2"},
+		{"extra column", "a\nb,c\n", Options{Header: true}, "line 2 has 2 columns, expected 1"},
+		{"bare quote", "a\"b,c\n", Options{}, "bare \" in non-quoted-field"},
+		{"line too long", "abc\n", Options{MaxLine: 2}, "line 1 is longer than the maximum of 2 bytes"},
+		{"blank line", "a\n\nb\n", Options{}, "line 2 is blank"},
+		{"field out of range", "a,b\n", Options{Fields: []int{2}}, "field 2 out of range"},
+		{"unknown field name", "x,y\n1,2\n", Options{FieldName: "z"}, `no column named "z"`},
+		{"unknown algorithm", "a\n", Options{Algorithm: "bubble"}, `unknown sorting algorithm "bubble"`},
+		{"invalid options", "a\n", Options{Head: 1, Tail: 1}, "head and tail can't be used at the same time"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := trySort(tt.in, tt.opts)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Sort error = %v, want one with %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// sign is -1, 0 or 1 like c.
+func sign(c int) int {
+	switch {
+	case c < 0:
+		return -1
+	case c > 0:
+		return 1
+	}
+	return 0
+}
+
+func TestCompareNatural(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"file2", "file10", -1},
+		{"file10", "file2", 1},
+		{"file1", "file1", 0},
+		{"b2a", "b10a", -1},
+		{"b2", "b2a", -1},
+		{"9", "10", -1},
+		{"100", "99", 1},
+		// equal numbers with more leading zeros go first
+		{"file01", "file1", -1},
+		{"file001", "file01", -1},
+		{"file01", "file2", -1},
+		{"a", "1", 1},
+	}
+	for _, tt := range tests {
+		if got := sign(compareNatural(tt.a, tt.b)); got != tt.want {
+			t.Errorf("compareNatural(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestNatural(t *testing.T) {
+	got := sortString(t, "file2\nfile10\nfile1\n", Options{Natural: true})
+	if want := "file1\nfile2\nfile10\n"; got != want {
+		t.Errorf("Sort = %q, want %q", got, want)
+	}
+}
+
+func TestFieldName(t *testing.T) {
+	const in = "name,price,qty\nb,3,1\na,1,3\nc,2,2\n"
+	byIndex := sortString(t, in, Options{Fields: []int{1}, Header: true})
+	tests := []struct {
+		name, field string
+		want        string
+		err         string
+	}{
+		{"middle column", "price", byIndex, ""},
+		{"last column", "qty", "name,price,qty\nb,3,1\nc,2,2\na,1,3\n", ""},
+		{"unknown", "cost", "", `no column named "cost", available columns: name, price, qty`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// FieldName implies Header
+			got, err := trySort(in, Options{FieldName: tt.field})
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Errorf("Sort error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("Sort = %q, %v; want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLongLines(t *testing.T) {
+	long := "a," + strings.Repeat("x", 64*1024+1) + "\n"
+	tests := []struct {
+		name string
+		in   string
+		opts Options
+		err  string
+	}{
+		{"over 64KB", "b,1\n" + long, Options{}, ""},
+		{"over 64KB split", "b::1\n" + strings.Replace(long, ",", "::", 1), Options{Delimiter: "::"}, ""},
+		{"at the maximum", "a,1\n", Options{MaxLine: 3}, ""},
+		{"over the maximum", "b,1\n" + long, Options{MaxLine: 64 * 1024}, "line 2 is longer than the maximum of 65536 bytes"},
+		{"over the maximum split", "b::1\nlonger::1\n", Options{Delimiter: "::", MaxLine: 6}, "line 2 is longer than the maximum of 6 bytes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := trySort(tt.in, tt.opts)
+			if tt.err == "" {
+				if err != nil {
+					t.Errorf("Sort: %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("Sort error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestColumnCountErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		opts Options
+		err  string
+	}{
+		{"more columns", "a,b,c\nd,e,f\ng,h,i,j\n", Options{}, "line 3 has 4 columns, expected 3"},
+		{"fewer columns", "a,b\nc\n", Options{}, "line 2 has 1 columns, expected 2"},
+		{"quoted line break", "a,b,c\n\"x\ny\",1,2\nq,1\n", Options{}, "line 4 has 2 columns, expected 3"},
+		{"after a comment", "# c\na,b,c\nq,1\n", Options{Comment: '#'}, "line 3 has 2 columns, expected 3"},
+		{"after a blank line", "a,b\n\nc\n", Options{SkipBlank: true}, "line 3 has 1 columns, expected 2"},
+		{"split", "a::b\nc\n", Options{Delimiter: "::"}, "line 2 has 1 columns, expected 2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := trySort(tt.in, tt.opts)
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("Sort error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestBlankLines(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		opts Options
+		want string
+		err  string
+	}{
+		{"skipped", "c,3\n\na,1\nb,2\n", Options{SkipBlank: true}, "a,1\nb,2\nc,3\n", ""},
+		{"several skipped", "c,3\n\n\na,1\n\n", Options{SkipBlank: true}, "a,1\nc,3\n", ""},
+		{"split skipped", "c::3\n\na::1\n", Options{SkipBlank: true, Delimiter: "::"}, "a::1\nc::3\n", ""},
+		{"error", "c,3\n\na,1\n", Options{}, "", "line 2 is blank"},
+		{"split error", "c::3\n\na::1\n", Options{Delimiter: "::"}, "", "line 2 is blank"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := trySort(tt.in, tt.opts)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Errorf("Sort error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("Sort = %q, %v; want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckRows(t *testing.T) {
+	tests := []struct {
+		name string
+		rows [][]string
+		opts Options
+		want Report
+	}{
+		{"valid", [][]string{{"b", "2"}, {"a", "1"}}, Options{}, Report{Rows: 2, Columns: 2}},
+		{"empty", nil, Options{}, Report{}},
+		{"header", [][]string{{"k", "v"}, {"a", "1"}}, Options{Header: true, Numeric: true, Fields: []int{1}}, Report{Rows: 1, Columns: 2}},
+		{"column count", [][]string{{"a", "1"}, {"b"}, {"c", "3", "x"}}, Options{}, Report{Rows: 3, Columns: 2, Problems: []string{
+			"row 2 has 1 columns, expected 2",
+			"row 3 has 3 columns, expected 2",
+		}}},
+		{"not numbers", [][]string{{"a", "1"}, {"b", "x"}}, Options{Numeric: true, Fields: []int{1}}, Report{Rows: 2, Columns: 2, Problems: []string{
+			`row 2: field 1 is not a number: "x"`,
+		}}},
+		{"field out of range", [][]string{{"a", "1"}}, Options{Fields: []int{5}}, Report{Rows: 1, Columns: 2, Problems: []string{
+			"field 5 out of range (file has 2 columns)",
+		}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := CheckRows(rowsNext(tt.rows), tt.opts)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("CheckRows = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDescribeRows(t *testing.T) {
+	mixed := [][]string{{"name", "age", "score"}, {"bob", "30", "9.5"}, {"ann", "100", ""}, {"", "25", "10"}, {"bob", "5", "x"}}
+	tests := []struct {
+		name string
+		rows [][]string
+		opts Options
+		want []Column
+	}{
+		{"mixed", mixed, Options{Header: true}, []Column{
+			{Name: "name", Min: "ann", Max: "bob", Distinct: 2, Nulls: 1},
+			{Name: "age", Numeric: true, Min: "5", Max: "100", Distinct: 4},
+			{Name: "score", Min: "10", Max: "x", Distinct: 3, Nulls: 1},
+		}},
+		{"no header", [][]string{{"b", "2"}, {"a", "10"}}, Options{}, []Column{
+			{Name: "0", Min: "a", Max: "b", Distinct: 2},
+			{Name: "1", Numeric: true, Min: "2", Max: "10", Distinct: 2},
+		}},
+		{"all nulls", [][]string{{"k"}, {""}, {""}}, Options{Header: true}, []Column{
+			{Name: "k", Nulls: 2},
+		}},
+		{"empty", nil, Options{}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := DescribeRows(rowsNext(tt.rows), tt.opts)
+			if len(got) != len(tt.want) {
+				t.Fatalf("DescribeRows gave %d columns, want %d", len(got), len(tt.want))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("DescribeRows = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestColumns(t *testing.T) {
+	const in = "k,v,w\nc,1,z\na,3,x\nb,2,y\n"
+	tests := []struct {
+		name string
+		opts Options
+		want string
+		err  string
+	}{
+		{"reordered", Options{Columns: []int{2, 0, 1}}, "x,a,3\ny,b,2\nz,c,1\nw,k,v\n", ""},
+		{"subset", Options{Columns: []int{1}, Header: true}, "v\n3\n2\n1\n", ""},
+		{"sorted by a dropped field", Options{Columns: []int{0, 2}, Fields: []int{1}, Header: true}, "k,w\nc,z\nb,y\na,x\n", ""},
+		{"repeated", Options{Columns: []int{0, 0}, Header: true}, "k,k\na,a\nb,b\nc,c\n", ""},
+		{"out of range", Options{Columns: []int{0, 3}}, "", "output column 3 out of range (file has 3 columns)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := trySort(in, tt.opts)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Errorf("Sort error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("Sort = %q, %v; want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestHeadTail(t *testing.T) {
+	const in = "n\n5\n3\n1\n4\n2\n"
+	tests := []struct {
+		name string
+		opts Options
+		want string
+		err  string
+	}{
+		{"head 3", Options{Head: 3, Header: true}, "n\n1\n2\n3\n", ""},
+		{"tail 2", Options{Tail: 2, Header: true}, "n\n4\n5\n", ""},
+		{"head over the rows", Options{Head: 10, Header: true}, "n\n1\n2\n3\n4\n5\n", ""},
+		{"tail over the rows", Options{Tail: 10, Header: true}, "n\n1\n2\n3\n4\n5\n", ""},
+		{"head descending", Options{Head: 2, Header: true, Order: Descending}, "n\n5\n4\n", ""},
+		{"both", Options{Head: 1, Tail: 1}, "", "head and tail can't be used at the same time"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := trySort(in, tt.opts)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Errorf("Sort error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("Sort = %q, %v; want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilters(t *testing.T) {
+	const in = "Bob,3,Austin\nAnn,1,Boston\nAl,2,Atlanta\nCy,4,Albany\n"
+	filter := func(field int, pattern string) Filter {
+		return Filter{Field: field, Pattern: regexp.MustCompile(pattern)}
+	}
+	tests := []struct {
+		name    string
+		filters []Filter
+		want    string
+	}{
+		{"matching", []Filter{filter(2, "^A")}, "Al,2,Atlanta\nBob,3,Austin\nCy,4,Albany\n"},
+		{"all must match", []Filter{filter(2, "^A"), filter(0, "^[AB]")}, "Al,2,Atlanta\nBob,3,Austin\n"},
+		{"none matching", []Filter{filter(1, "9")}, ""},
+		{"field out of range", []Filter{filter(5, "")}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := sortString(t, in, Options{Filters: tt.filters})
+			if got != tt.want {
+				t.Errorf("Sort = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConcurrentSorts(t *testing.T) {
+	// descending numbers, each goroutine with its own count and algorithm
+	input := func(n int) (string, string) {
+		var in, want strings.Builder
+		for i := n; i > 0; i-- {
+			fmt.Fprintf(&in, "%05d\n", i)
+			fmt.Fprintf(&want, "%05d\n", n+1-i)
+		}
+		return in.String(), want.String()
+	}
+	for i, alg := range []string{"builtin", "tree", "merge", "builtin", "tree", "merge"} {
+		in, want := input(500 + i*100)
+		t.Run(fmt.Sprintf("%s %d", alg, i), func(t *testing.T) {
+			t.Parallel()
+			for j := 0; j < 5; j++ {
+				got, err := trySort(in, Options{Algorithm: alg, Chunk: 64})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != want {
+					t.Fatalf("Sort wrote %d bytes, want %d, the sorts interfere", len(got), len(want))
+				}
+			}
+		})
+	}
+}
+
+func TestAutoDelimiter(t *testing.T) {
+	tests := []struct {
+		name, in  string
+		delim     string
+		detected  bool
+		wantFirst []string
+	}{
+		{"comma", "b,2\na,1\n", ",", true, []string{"b", "2"}},
+		{"tab", "b\t2\na\t1\n", "\t", true, []string{"b", "2"}},
+		{"semicolon", "b;2;x\na;1;y\n", ";", true, []string{"b", "2", "x"}},
+		{"pipe", "b|2\na|1\n", "|", true, []string{"b", "2"}},
+		{"comma inside quotes", "\"b;c\",2\n\"a;d\",1\n", ",", true, []string{"b;c", "2"}},
+		{"most frequent", "a,b;c;d\ne,f;g;h\n", ";", true, []string{"a,b", "c", "d"}},
+		{"tie", "a,b;c\nd,e;f\n", ",", false, []string{"a", "b;c"}},
+		{"inconsistent", "a;b\nc;d;e\n", ",", false, []string{"a;b"}},
+		{"one column", "abc\n", ",", false, []string{"abc"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rd, err := NewReader(strings.NewReader(tt.in), Options{Delimiter: AutoDelimiter})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if delim, detected := rd.Delimiter(); delim != tt.delim || detected != tt.detected {
+				t.Errorf("Delimiter() = %q, %v; want %q, %v", delim, detected, tt.delim, tt.detected)
+			}
+			if row, err := rd.Next(); err != nil || !reflect.DeepEqual(row, tt.wantFirst) {
+				t.Errorf("first row = %q, %v; want %q", row, err, tt.wantFirst)
+			}
+		})
+	}
+}
+
+func TestAutoDelimiterOutput(t *testing.T) {
+	got := sortString(t, "b\t2\na\t1\n", Options{Delimiter: AutoDelimiter})
+	if want := "a\t1\nb\t2\n"; got != want {
+		t.Errorf("Sort = %q, want %q", got, want)
+	}
+}
+
+func TestTrim(t *testing.T) {
+	tests := []struct {
+		name, in string
+		opts     Options
+		want     string
+	}{
+		{"padded fields", " b , 2\na ,1\n", Options{Trim: true}, "a,1\nb,2\n"},
+		{"tabs", "\tb\t,2\na\t,1\n", Options{Trim: true}, "a,1\nb,2\n"},
+		{"numbers", " 10 \n 9\n", Options{Trim: true, Numeric: true}, "9\n10\n"},
+		{"split", " b :: 2\na ::1\n", Options{Trim: true, Delimiter: "::"}, "a::1\nb::2\n"},
+		{"untrimmed", " b ,2\na ,1\n", Options{}, "\" b \",2\na ,1\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sortString(t, tt.in, tt.opts); got != tt.want {
+				t.Errorf("Sort = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQuote(t *testing.T) {
+	tests := []struct {
+		name, in string
+		want     [][]string
+		out      string
+	}{
+		{"delimiter inside", "'a,b',c\n", [][]string{{"a,b", "c"}}, "'a,b',c\n"},
+		{"doubled quote", "'it''s',d\n", [][]string{{"it's", "d"}}, "'it''s',d\n"},
+		{"double quotes are text", "x,\"y\"\n", [][]string{{"x", `"y"`}}, "x,\"y\"\n"},
+		{"line break inside", "'a\nb',c\n", [][]string{{"a\nb", "c"}}, "'a\nb',c\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := Options{Quote: '\''}
+			if got := readString(t, tt.in, opts); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("rows = %q, want %q", got, tt.want)
+			}
+			if got := sortString(t, tt.in, opts); got != tt.out {
+				t.Errorf("Sort = %q, want %q", got, tt.out)
+			}
+		})
+	}
+}
+
+func TestQuoteErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		opts Options
+		err  string
+	}{
+		{"not ASCII", Options{Quote: 'é'}, "the quote must be a single ASCII character"},
+		{"line break", Options{Quote: '\n'}, "the quote must be a single ASCII character"},
+		{"the delimiter", Options{Quote: ';', Delimiter: ";"}, "the quote and the delimiter can't be the same"},
+		{"the comment", Options{Quote: '#', Comment: '#'}, "the comment and the quote can't be the same"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.opts.Validate(); err == nil || err.Error() != tt.err {
+				t.Errorf("Validate() = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestDates(t *testing.T) {
+	const in = "01/02/2023\n15/12/2022\n02/01/2023\n"
+	const layout = "02/01/2006"
+	lexical := sortString(t, in, Options{})
+	tests := []struct {
+		name, in string
+		opts     Options
+		want     string
+	}{
+		{"chronological", in, Options{DateLayout: layout}, "15/12/2022\n02/01/2023\n01/02/2023\n"},
+		{"descending", in, Options{DateLayout: layout, Order: Descending}, "01/02/2023\n02/01/2023\n15/12/2022\n"},
+		{"unparseable first", "05/01/2023\nsoon\n01/02/2022\nlater\n", Options{DateLayout: layout}, "later\nsoon\n01/02/2022\n05/01/2023\n"},
+		{"time of day", "2023-01-05 10:00\n2023-01-05 09:30\n", Options{DateLayout: "2006-01-02 15:04"}, "2023-01-05 09:30\n2023-01-05 10:00\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := sortString(t, tt.in, tt.opts)
+			if got != tt.want {
+				t.Errorf("Sort = %q, want %q", got, tt.want)
+			}
+		})
+	}
+	if chrono := sortString(t, in, Options{DateLayout: layout}); chrono == lexical {
+		t.Errorf("chronological order %q is the lexical one", chrono)
+	}
+}
+
+func TestCompareDates(t *testing.T) {
+	compare := compareDates("02/01/2006")
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"01/02/2022", "03/01/2023", -1},
+		{"03/01/2023", "03/01/2023", 0},
+		{"31/12/2023", "01/01/2023", 1},
+		{"x", "01/01/2023", -1},
+		{"01/01/2023", "x", 1},
+		{"x", "y", -1},
+	}
+	for _, tt := range tests {
+		if got := sign(compare(tt.a, tt.b)); got != tt.want {
+			t.Errorf("compareDates(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestShuffle(t *testing.T) {
+	var b strings.Builder
+	b.WriteString("n\n")
+	for i := 0; i < 20; i++ {
+		fmt.Fprintf(&b, "%02d\n", i)
+	}
+	in := b.String()
+	sorted := sortString(t, in, Options{Header: true})
+	tests := []struct {
+		name string
+		seed int64
+	}{
+		{"seed 1", 1},
+		{"seed 42", 42},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := Options{Shuffle: true, Seed: tt.seed, Header: true}
+			first := sortString(t, in, opts)
+			if again := sortString(t, in, opts); again != first {
+				t.Errorf("the same seed gave %q, then %q", first, again)
+			}
+			if !strings.HasPrefix(first, "n\n") {
+				t.Errorf("shuffle moved the header: %q", first)
+			}
+			if first == in {
+				t.Errorf("shuffle kept the input order")
+			}
+			if back := sortString(t, first, Options{Header: true}); back != sorted {
+				t.Errorf("shuffled rows %q aren't a permutation of the input", first)
+			}
+		})
+	}
+	if a, b := sortString(t, in, Options{Shuffle: true, Seed: 1}), sortString(t, in, Options{Shuffle: true, Seed: 42}); a == b {
+		t.Errorf("seeds 1 and 42 gave the same order %q", a)
+	}
+}
+
+// sortedRows returns n rows in ascending order.
+func sortedRows(n int) [][]string {
+	rows := make([][]string, n)
+	for i := range rows {
+		rows[i] = []string{fmt.Sprintf("%06d", i)}
+	}
+	return rows
+}
+
+// checkBalanced fails unless every node of the subtree has the right height
+// and sides differing by at most one level.
+func checkBalanced(t *testing.T, n *Node) {
+	t.Helper()
+	if n == nil {
+		return
+	}
+	checkBalanced(t, n.left)
+	checkBalanced(t, n.right)
+	if d := height(n.left) - height(n.right); d < -1 || d > 1 {
+		t.Fatalf("node %v has sides of heights %d and %d", n.data, height(n.left), height(n.right))
+	}
+	if n.height != 1+max(height(n.left), height(n.right)) {
+		t.Fatalf("node %v has height %d", n.data, n.height)
+	}
+}
+
+func TestTreeBalanced(t *testing.T) {
+	compare := Options{}.byFields()
+	up := sortedRows(10000)
+	down := make([][]string, len(up))
+	for i, row := range up {
+		down[len(up)-1-i] = row
+	}
+	tests := []struct {
+		name string
+		rows [][]string
+	}{
+		{"ascending", up},
+		{"descending", down},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tree := &Tree{}
+			for _, row := range tt.rows {
+				tree.insert(row, compare)
+			}
+			checkBalanced(t, tree.root)
+			// an AVL tree of 10,000 nodes is at most 1.44 log2(10,000) high
+			if h := height(tree.root); h > 19 {
+				t.Errorf("tree of %d rows is %d high", len(tt.rows), h)
+			}
+			var got [][]string
+			tree.root.rewriteTree(&got)
+			if !reflect.DeepEqual(got, up) {
+				t.Errorf("the tree walk isn't in order")
+			}
+		})
+	}
+}
+
+func TestTreeEqualKeys(t *testing.T) {
+	compare := Options{Fields: []int{0}}.byFields()
+	tests := []struct {
+		name string
+		rows [][]string
+	}{
+		{"all equal", [][]string{{"a", "1"}, {"a", "2"}, {"a", "3"}, {"a", "4"}, {"a", "5"}}},
+		{"mixed", [][]string{{"b", "1"}, {"a", "2"}, {"b", "3"}, {"a", "4"}, {"b", "5"}, {"a", "6"}}},
+		{"equal after rotations", [][]string{{"c", "1"}, {"b", "2"}, {"a", "3"}, {"b", "4"}, {"a", "5"}, {"c", "6"}, {"b", "7"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tree := &Tree{}
+			for _, row := range tt.rows {
+				tree.insert(row, compare)
+			}
+			var got [][]string
+			tree.root.rewriteTree(&got)
+			want := append([][]string(nil), tt.rows...)
+			sort.SliceStable(want, func(i, j int) bool { return want[i][0] < want[j][0] })
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("tree walk = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+// naiveInsert is Node.insert without balancing, as tree sort was first.
+func naiveInsert(n *Node, data []string, compare func(a, b []string) int) *Node {
+	if n == nil {
+		return &Node{data: data}
+	}
+	if compare(data, n.data) < 0 {
+		n.left = naiveInsert(n.left, data, compare)
+	} else {
+		n.right = naiveInsert(n.right, data, compare)
+	}
+	return n
+}
+
+func BenchmarkTreeSort(b *testing.B) {
+	compare := Options{}.byFields()
+	rows := sortedRows(5000)
+	b.Run("balanced", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			tree := &Tree{}
+			for _, row := range rows {
+				tree.insert(row, compare)
+			}
+		}
+	})
+	b.Run("naive", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			var root *Node
+			for _, row := range rows {
+				root = naiveInsert(root, row, compare)
+			}
+		}
+	})
+}
+
+func TestParallelSort(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	var b strings.Builder
+	for i := 0; i < 1000; i++ {
+		// few distinct keys, so stability shows
+		fmt.Fprintf(&b, "%d,%d,%d\n", random.Intn(50), random.Intn(10), i)
+	}
+	in := b.String()
+	tests := []struct {
+		name string
+		opts Options
+	}{
+		{"first field", Options{}},
+		{"numeric", Options{Numeric: true}},
+		{"descending", Options{Numeric: true, Order: Descending}},
+		{"two fields", Options{Fields: []int{1, 0}, Orders: []Order{Descending}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serial, parallel := tt.opts, tt.opts
+			serial.Stable, parallel.Parallel = true, true
+			if got, want := sortString(t, in, parallel), sortString(t, in, serial); got != want {
+				t.Errorf("parallel sort differs from the serial one")
+			}
+		})
+	}
+}
+
+func TestParallelSortParts(t *testing.T) {
+	less := func(a, b []string) bool { return a[0] < b[0] }
+	for _, size := range []int{0, 1, 2, 7, 100} {
+		for _, n := range []int{1, 2, 3, 4, 8, 200} {
+			rows := make([][]string, size)
+			for i := range rows {
+				rows[i] = []string{fmt.Sprint(i % 5), fmt.Sprint(i)}
+			}
+			want := make([][]string, size)
+			copy(want, rows)
+			sort.SliceStable(want, func(i, j int) bool { return less(want[i], want[j]) })
+			parallelSort(rows, less, n)
+			if !reflect.DeepEqual(rows, want) {
+				t.Errorf("%d rows in %d parts = %v, want %v", size, n, rows, want)
+			}
+		}
+	}
+}
+
+func BenchmarkParallelSort(b *testing.B) {
+	random := rand.New(rand.NewSource(1))
+	var in strings.Builder
+	for i := 0; i < 100000; i++ {
+		fmt.Fprintf(&in, "%d,x\n", random.Int63())
+	}
+	rd, err := NewReader(strings.NewReader(in.String()), Options{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	rows, err := rd.ReadAll()
+	if err != nil {
+		b.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		opts Options
+	}{
+		{"serial", Options{Stable: true, Numeric: true}},
+		{"parallel", Options{Parallel: true, Numeric: true}},
+	}
+	for _, tt := range tests {
+		b.Run(tt.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				data := append([][]string(nil), rows...)
+				b.StartTimer()
+				sorted, err := SortRows(data, tt.opts)
+				if err != nil {
+					b.Fatal(err)
+				}
+				sorted.Close()
+			}
+		})
+	}
+}
+
+func TestAlgorithms(t *testing.T) {
+	if got, want := Algorithms(), []string{"builtin", "merge", "tree"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Algorithms() = %q, want %q", got, want)
+	}
+	tests := []struct {
+		name string
+		err  string
+	}{
+		{"", ""},
+		{"builtin", ""},
+		{"tree", ""},
+		{"merge", ""},
+		{"bubble", `unknown sorting algorithm "bubble", valid ones are builtin, merge, tree`},
+		{"2", `unknown sorting algorithm "2", valid ones are builtin, merge, tree`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Options{Algorithm: tt.name}.Validate()
+			if tt.err == "" {
+				if err != nil {
+					t.Errorf("Validate() = %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("Validate() = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestSplitWidths(t *testing.T) {
+	tests := []struct {
+		line   string
+		widths []int
+		want   []string
+	}{
+		{"bob       30", []int{10, 2}, []string{"bob", "30"}},
+		{"al        4", []int{10, 2}, []string{"al", "4"}},
+		{"x", []int{10, 2}, []string{"x", ""}},
+		{"", []int{3, 3}, []string{"", ""}},
+		{"abcdefgh", []int{3, 2}, []string{"abc", "defgh"}},
+	}
+	for _, tt := range tests {
+		if got := splitWidths(tt.line, tt.widths); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitWidths(%q, %v) = %q, want %q", tt.line, tt.widths, got, tt.want)
+		}
+	}
+}
+
+func TestFixedWidths(t *testing.T) {
+	const in = "bob       30\nal        04\ncy        12\n"
+	tests := []struct {
+		name, in string
+		opts     Options
+		want     string
+		err      string
+	}{
+		{"second field", in, Options{Widths: []int{10, 2}, Fields: []int{1}}, "al,04\ncy,12\nbob,30\n", ""},
+		{"numeric", in, Options{Widths: []int{10, 2}, Fields: []int{1}, Numeric: true, Order: Descending}, "bob,30\ncy,12\nal,04\n", ""},
+		{"fixed-width output", in, Options{Widths: []int{10, 2}, Fields: []int{1}, OutWidths: []int{5, 3}}, "al   04\ncy   12\nbob  30\n", ""},
+		{"short line", "x\nbob       30\n", Options{Widths: []int{10, 2}}, "bob,30\nx,\n", ""},
+		{"zero width", in, Options{Widths: []int{0, 2}}, "", "field widths must be positive"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := trySort(tt.in, tt.opts)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Errorf("Sort error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("Sort = %q, %v; want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestComments(t *testing.T) {
+	tests := []struct {
+		name, in string
+		opts     Options
+		want     [][]string
+	}{
+		{"interleaved", "# meta\nb,2\n# more\na,1\n#\n", Options{Comment: '#'}, [][]string{{"b", "2"}, {"a", "1"}}},
+		{"indented", "  # meta\n\t# more\nb,2\n", Options{Comment: '#'}, [][]string{{"b", "2"}}},
+		{"not first", "a#b,1\n", Options{Comment: '#'}, [][]string{{"a#b", "1"}}},
+		{"inside quotes", "a,\"x\n# not a comment\",1\n# c\nb,2,3\n", Options{Comment: '#'}, [][]string{{"a", "x\n# not a comment", "1"}, {"b", "2", "3"}}},
+		{"other character", "; meta\n# data,1\n", Options{Comment: ';'}, [][]string{{"# data", "1"}}},
+		{"split", "# meta\nb::2\n", Options{Comment: '#', Delimiter: "::"}, [][]string{{"b", "2"}}},
+		{"off", "# meta\n", Options{}, [][]string{{"# meta"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := readString(t, tt.in, tt.opts); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("rows = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCommentsSorted(t *testing.T) {
+	got := sortString(t, "k,v\n# meta\nc,3\n# more\na,1\nb,2\n", Options{Comment: '#', Header: true})
+	if want := "k,v\na,1\nb,2\nc,3\n"; got != want {
+		t.Errorf("Sort = %q, want %q", got, want)
+	}
+}
+
+func TestKeyRange(t *testing.T) {
+	tests := []struct {
+		name, in string
+		opts     Options
+		want     string
+	}{
+		{"blanks", "  b\na\n c\n", Options{Blanks: true}, "a\n\"  b\"\n\" c\"\n"},
+		{"tabs", "\tb\na\n", Options{Blanks: true}, "a\n\"\tb\"\n"},
+		{"with blanks", "  b\na\n c\n", Options{}, "\"  b\"\n\" c\"\na\n"},
+		{"from a byte", "x-10\ny-9\nz-2\n", Options{KeyStart: 2, Numeric: true}, "z-2\ny-9\nx-10\n"},
+		{"byte range", "a3b\nb1c\nc2a\n", Options{KeyStart: 1, KeyEnd: 2}, "b1c\nc2a\na3b\n"},
+		{"range past the end", "ab\nb\nca\n", Options{KeyStart: 1, KeyEnd: 5}, "b\nca\nab\n"},
+		{"ignoring case", "aB\nAa\nac\n", Options{KeyStart: 1, IgnoreCase: true}, "Aa\naB\nac\n"},
+		{"blanks then range", "  x2\n x1\n", Options{Blanks: true, KeyStart: 1}, "\" x1\"\n\"  x2\"\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sortString(t, tt.in, tt.opts); got != tt.want {
+				t.Errorf("Sort = %q, want %q", got, tt.want)
+			}
+		})
+	}
+	if err := (Options{KeyStart: 3, KeyEnd: 2}).Validate(); err == nil {
+		t.Error("Validate() accepted a key ending before it starts")
+	}
+}
+
+func TestCRLF(t *testing.T) {
+	tests := []struct {
+		name, in string
+		opts     Options
+		rows     [][]string
+		want     string
+	}{
+		{"read", "b,2\r\na,1\r\n", Options{}, [][]string{{"b", "2"}, {"a", "1"}}, "a,1\nb,2\n"},
+		{"read split", "b::2\r\na::1\r\n", Options{Delimiter: "::"}, [][]string{{"b", "2"}, {"a", "1"}}, "a::1\nb::2\n"},
+		{"read fixed widths", "b 2\r\na 1\r\n", Options{Widths: []int{2, 1}}, [][]string{{"b", "2"}, {"a", "1"}}, "a,1\nb,2\n"},
+		{"write", "b,2\na,1\n", Options{CRLF: true}, [][]string{{"b", "2"}, {"a", "1"}}, "a,1\r\nb,2\r\n"},
+		{"write split", "b::2\r\na::1\n", Options{Delimiter: "::", CRLF: true}, [][]string{{"b", "2"}, {"a", "1"}}, "a::1\r\nb::2\r\n"},
+		{"write table", "k,v\nb,2\n", Options{Format: "table", Header: true, CRLF: true}, [][]string{{"k", "v"}, {"b", "2"}}, "k  v\r\n-  -\r\nb  2\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := readString(t, tt.in, tt.opts); !reflect.DeepEqual(got, tt.rows) {
+				t.Errorf("rows = %q, want %q", got, tt.rows)
+			}
+			if got := sortString(t, tt.in, tt.opts); got != tt.want {
+				t.Errorf("Sort = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOutputDelimiter(t *testing.T) {
+	tests := []struct {
+		name, in string
+		opts     Options
+		want     string
+	}{
+		{"comma to tab", "b,2\na,1\n", Options{OutDelim: "\t"}, "a\t1\nb\t2\n"},
+		{"quoted comma to tab", "b,\"p,q\"\n", Options{OutDelim: "\t"}, "b\tp,q\n"},
+		{"tab inside a field", "b,\"x\ty\"\n", Options{OutDelim: "\t"}, "b\t\"x\ty\"\n"},
+		{"tab to comma", "b\t2\na\t1\n", Options{Delimiter: "\t", OutDelim: ","}, "a,1\nb,2\n"},
+		{"several characters", "b,2\n", Options{OutDelim: ";;"}, "b;;2\n"},
+		{"input delimiter", "b;2\na;1\n", Options{Delimiter: ";"}, "a;1\nb;2\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := sortString(t, tt.in, tt.opts)
+			if got != tt.want {
+				t.Errorf("Sort = %q, want %q", got, tt.want)
+			}
+			// the fields are the same as with the input delimiter
+			in := tt.opts
+			in.OutDelim = ""
+			back := Options{Delimiter: tt.opts.outDelimiter()}
+			if rows, want := readString(t, got, back), readString(t, sortString(t, tt.in, in), in); !reflect.DeepEqual(rows, want) {
+				t.Errorf("read back %q, want %q", rows, want)
+			}
+		})
+	}
+}
+
+func TestTranspose(t *testing.T) {
+	tests := []struct {
+		name string
+		rows [][]string
+		want [][]string
+		err  string
+	}{
+		{"2x3", [][]string{{"1", "2", "3"}, {"4", "5", "6"}}, [][]string{{"1", "4"}, {"2", "5"}, {"3", "6"}}, ""},
+		{"one row", [][]string{{"a", "b"}}, [][]string{{"a"}, {"b"}}, ""},
+		{"empty", [][]string{}, [][]string{}, ""},
+		{"ragged", [][]string{{"1", "2"}, {"3"}}, nil, "row 2 has 1 columns, expected 2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := transpose(tt.rows)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Errorf("transpose error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("transpose = %q, %v; want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestTransposeSort(t *testing.T) {
+	tests := []struct {
+		name, in string
+		opts     Options
+		want     string
+	}{
+		{"2x3", "1,2,3\n4,5,6\n", Options{Transpose: true}, "1,4\n2,5\n3,6\n"},
+		{"sorted after", "c,1\nb,2\na,3\n", Options{Transpose: true, Fields: []int{2}}, "1,2,3\nc,b,a\n"},
+		{"descending", "1,2,3\n4,5,6\n", Options{Transpose: true, Order: Descending}, "3,6\n2,5\n1,4\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sortString(t, tt.in, tt.opts); got != tt.want {
+				t.Errorf("Sort = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNumber(t *testing.T) {
+	tests := []struct {
+		name, in string
+		opts     Options
+		want     string
+	}{
+		{"rows", "c\na\nb\n", Options{Number: true}, "1,a\n2,b\n3,c\n"},
+		{"header", "k,v\nb,2\na,1\n", Options{Number: true, Header: true}, "number,k,v\n1,a,1\n2,b,2\n"},
+		{"descending", "a\nc\nb\n", Options{Number: true, Order: Descending}, "1,c\n2,b\n3,a\n"},
+		{"after head", "c\na\nb\n", Options{Number: true, Head: 2}, "1,a\n2,b\n"},
+		{"sort field unchanged", "a,2\nb,1\n", Options{Number: true, Fields: []int{1}}, "1,b,1\n2,a,2\n"},
+		{"empty", "", Options{Number: true}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sortString(t, tt.in, tt.opts); got != tt.want {
+				t.Errorf("Sort = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeyOrders(t *testing.T) {
+	const in = "a,1\nb,2\na,3\nb,1\n"
+	tests := []struct {
+		name string
+		opts Options
+		want string
+	}{
+		{"ascending then descending", Options{Fields: []int{0, 1}, Orders: []Order{Ascending, Descending}}, "a,3\na,1\nb,2\nb,1\n"},
+		{"descending then ascending", Options{Fields: []int{0, 1}, Orders: []Order{Descending, Ascending}}, "b,1\nb,2\na,1\na,3\n"},
+		{"missing orders are ascending", Options{Fields: []int{0, 1}, Orders: []Order{Descending}}, "b,1\nb,2\na,1\na,3\n"},
+		{"whole sort reversed", Options{Fields: []int{0, 1}, Orders: []Order{Ascending, Descending}, Order: Descending}, "b,1\nb,2\na,1\na,3\n"},
+		{"numeric", Options{Fields: []int{1, 0}, Orders: []Order{Descending, Descending}, Numeric: true}, "a,3\nb,2\nb,1\na,1\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, alg := range Algorithms() {
+				opts := tt.opts
+				opts.Algorithm = alg
+				if got := sortString(t, in, opts); got != tt.want {
+					t.Errorf("%s sort = %q, want %q", alg, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestLooksLikeHeader(t *testing.T) {
+	tests := []struct {
+		name string
+		rows [][]string
+		want bool
+	}{
+		{"obvious header", [][]string{{"name", "age"}, {"bob", "30"}, {"al", "4"}}, true},
+		{"all numbers", [][]string{{"1", "2"}, {"3", "4"}}, false},
+		{"no numeric column", [][]string{{"name", "city"}, {"bob", "Rome"}}, false},
+		{"number in the first row", [][]string{{"name", "2020"}, {"bob", "30"}}, false},
+		{"one row", [][]string{{"name", "age"}}, false},
+		{"column with text", [][]string{{"name", "age"}, {"bob", "30"}, {"al", "n/a"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := looksLikeHeader(tt.rows); got != tt.want {
+				t.Errorf("looksLikeHeader(%q) = %v, want %v", tt.rows, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAutoHeader(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"detected", "name,age\nbob,30\nal,4\n", "name,age\nal,4\nbob,30\n"},
+		{"not detected", "3,1\n1,2\n2,3\n", "1,2\n2,3\n3,1\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sortString(t, tt.in, Options{AutoHeader: true}); got != tt.want {
+				t.Errorf("Sort = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStats(t *testing.T) {
+	tests := []struct {
+		name, in string
+		opts     Options
+		want     Stats
+	}{
+		{"rows", "b,2\na,1\nc,3\n", Options{}, Stats{Rows: 3, Columns: 2, Min: "a", Max: "c"}},
+		{"header", "k,v\nb,2\na,1\n", Options{Header: true, Fields: []int{1}}, Stats{Rows: 2, Columns: 2, Min: "1", Max: "2"}},
+		{"duplicates", "b,2\na,1\nb,2\nb,2\n", Options{Unique: true}, Stats{Rows: 4, Columns: 2, Duplicates: 2, Min: "a", Max: "b"}},
+		{"numeric", "10\n9\n100\n", Options{Numeric: true}, Stats{Rows: 3, Columns: 1, Min: "9", Max: "100"}},
+		{"last field", "a,3\nb,1\n", Options{Fields: []int{-1}}, Stats{Rows: 2, Columns: 2, Min: "1", Max: "3"}},
+		{"field name", "k,v\nb,2\na,1\n", Options{FieldName: "v"}, Stats{Rows: 2, Columns: 2, Min: "1", Max: "2"}},
+		{"empty", "", Options{}, Stats{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var st Stats
+			opts := tt.opts
+			opts.Stats = &st
+			sortString(t, tt.in, opts)
+			if st != tt.want {
+				t.Errorf("Stats = %+v, want %+v", st, tt.want)
+			}
+		})
+	}
+}
+
+func TestNulls(t *testing.T) {
+	const in = "b,2\n,5\na,1\nNA,3\n"
+	tests := []struct {
+		name string
+		opts Options
+		want string
+	}{
+		{"first ascending", Options{Nulls: "first"}, ",5\nNA,3\na,1\nb,2\n"},
+		{"first descending", Options{Nulls: "first", Order: Descending}, ",5\nb,2\na,1\nNA,3\n"},
+		{"last ascending", Options{Nulls: "last"}, "NA,3\na,1\nb,2\n,5\n"},
+		{"last descending", Options{Nulls: "last", Order: Descending}, "b,2\na,1\nNA,3\n,5\n"},
+		{"null value first", Options{Nulls: "first", NullValue: "NA"}, "NA,3\n,5\na,1\nb,2\n"},
+		{"null value last descending", Options{Nulls: "last", NullValue: "NA", Order: Descending}, "b,2\na,1\n,5\nNA,3\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			opts.Stable = true
+			if got := sortString(t, in, opts); got != tt.want {
+				t.Errorf("Sort = %q, want %q", got, tt.want)
+			}
+		})
+	}
+	if err := (Options{Nulls: "middle"}).Validate(); err == nil || err.Error() != `nulls can go first or last, not "middle"` {
+		t.Errorf("Validate() = %v", err)
+	}
+}
+
+func TestRagged(t *testing.T) {
+	tests := []struct {
+		name, in string
+		opts     Options
+		want     string
+		err      string
+	}{
+		{"padded", "b,2,x\na\nc,3\n", Options{Ragged: true}, "a,,\nb,2,x\nc,3,\n", ""},
+		{"widest later", "a\nb,2,x\n", Options{Ragged: true}, "a,,\nb,2,x\n", ""},
+		{"sorted on a missing field", "c,1\nb\n", Options{Ragged: true, Fields: []int{1}}, "b,\nc,1\n", ""},
+		{"split", "b::2\na\n", Options{Ragged: true, Delimiter: "::"}, "a::\nb::2\n", ""},
+		{"strict", "b,2,x\na\n", Options{}, "", "line 2 has 1 columns, expected 3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := trySort(tt.in, tt.opts)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Errorf("Sort error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("Sort = %q, %v; want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestReaderNext(t *testing.T) {
+	tests := []struct {
+		name, in string
+		opts     Options
+		want     [][]string
+	}{
+		{"rows", "b,2\na,1\n", Options{}, [][]string{{"b", "2"}, {"a", "1"}}},
+		{"no final newline", "b,2\na,1", Options{}, [][]string{{"b", "2"}, {"a", "1"}}},
+		{"empty", "", Options{}, nil},
+		{"delimiter", "b;2\n", Options{Delimiter: ";"}, [][]string{{"b", "2"}}},
+		{"quotes", "'b,c',2\n", Options{Quote: '\''}, [][]string{{"b,c", "2"}}},
+		{"comments", "# x\nb,2\n", Options{Comment: '#'}, [][]string{{"b", "2"}}},
+		{"encoding", "\xe4,1\n", Options{Encoding: "latin1"}, [][]string{{"ä", "1"}}},
+		{"not sorted", "c\nb\na\n", Options{Header: true}, [][]string{{"c"}, {"b"}, {"a"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rd, err := NewReader(strings.NewReader(tt.in), tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got [][]string
+			for {
+				row, err := rd.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("Next: %v", err)
+				}
+				got = append(got, row)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("rows = %q, want %q", got, tt.want)
+			}
+			// io.EOF again after the last row
+			if _, err := rd.Next(); err != io.EOF {
+				t.Errorf("Next after the last row = %v, want io.EOF", err)
+			}
+		})
+	}
+}
+
+func TestReaderErrors(t *testing.T) {
+	failed := errors.New("disk failed")
+	tests := []struct {
+		name string
+		r    io.Reader
+		opts Options
+		err  string
+	}{
+		{"invalid options", strings.NewReader(""), Options{Head: 1, Tail: 1}, "head and tail can't be used at the same time"},
+		{"columns", strings.NewReader("a,b\nc\n"), Options{}, "line 2 has 1 columns, expected 2"},
+		{"read error", io.MultiReader(strings.NewReader("a,b\n"), &errReader{failed}), Options{}, "disk failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rd, err := NewReader(tt.r, tt.opts)
+			if err == nil {
+				_, err = rd.ReadAll()
+			}
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+// errReader fails every read with err.
+type errReader struct {
+	err error
+}
+
+func (e *errReader) Read(p []byte) (int, error) {
+	return 0, e.err
+}
+
+func TestReaderReject(t *testing.T) {
+	var rejected []string
+	opts := Options{Reject: func(row []string, err error) {
+		rejected = append(rejected, err.Error())
+	}}
+	got := readString(t, "a,1\nb\nc,3\n", opts)
+	if want := [][]string{{"a", "1"}, {"c", "3"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("rows = %q, want %q", got, want)
+	}
+	if want := []string{"line 2 has 1 columns, expected 2"}; !reflect.DeepEqual(rejected, want) {
+		t.Errorf("rejected %q, want %q", rejected, want)
+	}
+}
+
+func TestReject(t *testing.T) {
+	tests := []struct {
+		name, in string
+		opts     Options
+		want     string
+		rejected [][]string
+	}{
+		{"column count", "b,2\nx\na,1\n", Options{}, "a,1\nb,2\n", [][]string{{"x"}}},
+		{"not a number", "b,2\nc,zz\na,1\n", Options{Fields: []int{1}, Numeric: true}, "a,1\nb,2\n", [][]string{{"c", "zz"}}},
+		{"not a sort field", "2,b\n3,zz\n1,a\n", Options{Fields: []int{0}, Numeric: true}, "1,a\n2,b\n3,zz\n", nil},
+		{"header", "k,n\nb,2\nx\na,1\n", Options{Header: true}, "k,n\na,1\nb,2\n", [][]string{{"x"}}},
+		{"none", "b,2\na,1\n", Options{}, "a,1\nb,2\n", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var rejected [][]string
+			tt.opts.Reject = func(row []string, err error) {
+				rejected = append(rejected, row)
+			}
+			if got := sortString(t, tt.in, tt.opts); got != tt.want {
+				t.Errorf("Sort = %q, want %q", got, tt.want)
+			}
+			if !reflect.DeepEqual(rejected, tt.rejected) {
+				t.Errorf("rejected %q, want %q", rejected, tt.rejected)
+			}
+		})
+	}
+}
+
+func TestMonths(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+		opts           Options
+	}{
+		{"short names", "Mar\nJan\nFeb\n", "Jan\nFeb\nMar\n", Options{Month: true}},
+		{"full names", "December\nMay\nApril\n", "April\nMay\nDecember\n", Options{Month: true}},
+		{"mixed and any case", "mar\nFEBRUARY\njan\n", "jan\nFEBRUARY\nmar\n", Options{Month: true}},
+		{"unrecognized first", "Feb\nsoon\nJan\n", "soon\nJan\nFeb\n", Options{Month: true}},
+		{"descending", "Mar\nJan\nFeb\n", "Mar\nFeb\nJan\n", Options{Month: true, Order: Descending}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sortString(t, tt.in, tt.opts); got != tt.want {
+				t.Errorf("Sort = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMonth(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int
+	}{
+		{"Jan", 1}, {"january", 1}, {" Sep ", 9}, {"DEC", 12}, {"Sept", 0}, {"", 0}, {"Ja", 0},
+	}
+	for _, tt := range tests {
+		if got := parseMonth(tt.s); got != tt.want {
+			t.Errorf("parseMonth(%q) = %d, want %d", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.2.9", "1.2.10", -1},
+		{"1.2.10", "1.2.9", 1},
+		{"1.2", "1.2.0", -1},
+		{"1.2.0", "1.2", 1},
+		{"1.2", "1.2.1", -1},
+		{"1.10", "1.9.9", 1},
+		{"2.0", "10.0", -1},
+		{"1.2.3", "1.2.3", 0},
+		{"1.2.rc1", "1.2.rc2", -1},
+		{"1.2.beta", "1.2.alpha", 1},
+		{"1.02", "1.2", -1},
+	}
+	for _, tt := range tests {
+		if got := sign(compareVersions(tt.a, tt.b)); got != tt.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestVersions(t *testing.T) {
+	got := sortString(t, "1.2.10\n1.2\n1.10\n1.2.9\n1.2.0\n", Options{Version: true})
+	if want := "1.2\n1.2.0\n1.2.9\n1.2.10\n1.10\n"; got != want {
+		t.Errorf("Sort = %q, want %q", got, want)
+	}
+}
+
+func TestCompareIPs(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"10.0.0.2", "10.0.0.10", -1},
+		{"192.168.1.1", "10.0.0.1", 1},
+		{"10.0.0.1", "::1", 1},
+		{"::1", "2001:db8::1", -1},
+		{"10.0.0.1", "::ffff:10.0.0.1", -1},
+		{"10.0.0.1", " 10.0.0.1", 1},
+		{"not an ip", "0.0.0.0", -1},
+		{"::", "x", 1},
+		{"x", "y", -1},
+	}
+	for _, tt := range tests {
+		if got := sign(compareIPs(tt.a, tt.b)); got != tt.want {
+			t.Errorf("compareIPs(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestIPs(t *testing.T) {
+	got := sortString(t, "10.0.0.10\n2001:db8::1\n10.0.0.2\nunknown\n::1\n", Options{IP: true})
+	if want := "unknown\n::1\n10.0.0.2\n10.0.0.10\n2001:db8::1\n"; got != want {
+		t.Errorf("Sort = %q, want %q", got, want)
+	}
+}
+
+func TestThousandsAndUnits(t *testing.T) {
+	tests := []struct {
+		name, in string
+		opts     Options
+		want     string
+		err      string
+	}{
+		{"thousands", "1,000\n999\n", Options{Numeric: true, Thousands: ",", Delimiter: ";"}, "999\n1,000\n", ""},
+		{"thousands and decimals", "1,234.50\n1,234.05\n12\n", Options{Numeric: true, Thousands: ",", Delimiter: ";"}, "12\n1,234.05\n1,234.50\n", ""},
+		{"dot separator", "1.000.000\n2.000\n", Options{Numeric: true, Thousands: "."}, "2.000\n1.000.000\n", ""},
+		{"without the separator", "1,000\n999\n", Options{Numeric: true, Delimiter: ";"}, "1,000\n999\n", ""},
+		{"units", "2K\n1500\n", Options{Numeric: true, Units: true}, "1500\n2K\n", ""},
+		{"all units", "1G\n3M\n2k\n5\n", Options{Numeric: true, Units: true}, "5\n2k\n3M\n1G\n", ""},
+		{"units and thousands", "1,500K\n2M\n", Options{Numeric: true, Units: true, Thousands: ",", Delimiter: ";"}, "1,500K\n2M\n", ""},
+		{"separator is the delimiter", "1\n", Options{Numeric: true, Thousands: ","}, "", "the thousands separator and the delimiter can't be the same"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := trySort(tt.in, tt.opts)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Errorf("Sort error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("Sort = %q, %v; want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRowRange(t *testing.T) {
+	const in = "n\n9\n8\n7\n6\n5\n4\n"
+	tests := []struct {
+		name string
+		opts Options
+		want string
+		err  string
+	}{
+		{"middle", Options{From: 2, To: 4}, "7\n8\n9\n", ""},
+		{"with a header", Options{From: 2, To: 4, Header: true}, "n\n6\n7\n8\n", ""},
+		{"from only", Options{From: 5, Header: true}, "n\n4\n5\n", ""},
+		{"to only", Options{To: 2, Header: true}, "n\n8\n9\n", ""},
+		{"to past the end", Options{From: 5, To: 100, Header: true}, "n\n4\n5\n", ""},
+		{"from past the end", Options{From: 100, Header: true}, "n\n", ""},
+		{"one row", Options{From: 3, To: 3, Header: true}, "n\n7\n", ""},
+		{"after the limit", Options{From: 2, Limit: 3, Header: true}, "n\n7\n8\n", ""},
+		{"backwards", Options{From: 3, To: 2}, "", "the row range ends before it starts"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := trySort(in, tt.opts)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Errorf("Sort error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("Sort = %q, %v; want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestHeadLines(t *testing.T) {
+	tests := []struct {
+		name, in string
+		opts     Options
+		want     string
+		err      string
+	}{
+		{"two lines", "report,2024\nk,v\nb,2\na,1\nc,3\n", Options{HeadLines: 2}, "report,2024\nk,v\na,1\nb,2\nc,3\n", ""},
+		{"descending", "report,2024\nk,v\nb,2\na,1\nc,3\n", Options{HeadLines: 2, Order: Descending}, "report,2024\nk,v\nc,3\nb,2\na,1\n", ""},
+		{"ragged title", "title\nk,v\nb,2\na,1\n", Options{HeadLines: 2, Ragged: true}, "title,\nk,v\na,1\nb,2\n", ""},
+		{"more than the rows", "b\na\n", Options{HeadLines: 5}, "b\na\n", ""},
+		{"one like Header", "k\nb\na\n", Options{HeadLines: 1}, "k\na\nb\n", ""},
+		{"with Header", "t\nk\nb\na\n", Options{HeadLines: 2, Header: true}, "t\nk\na\nb\n", ""},
+		{"negative", "a\n", Options{HeadLines: -1}, "", "the number of header lines can't be negative"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := trySort(tt.in, tt.opts)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Errorf("Sort error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("Sort = %q, %v; want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDuplicateHeaders(t *testing.T) {
+	const in = "id,name,id\n2,b,1\n1,a,3\n3,c,2\n"
+	tests := []struct {
+		name string
+		opts Options
+		want string
+		err  string
+	}{
+		{"duplicate", Options{FieldName: "id"}, "", `column name "id" is used more than once in the header`},
+		{"another column", Options{FieldName: "name"}, "", `column name "id" is used more than once in the header`},
+		{"first taken", Options{FieldName: "id", AllowDups: true}, "id,name,id\n1,a,3\n2,b,1\n3,c,2\n", ""},
+		{"unique with dups allowed", Options{FieldName: "name", AllowDups: true}, "id,name,id\n1,a,3\n2,b,1\n3,c,2\n", ""},
+		{"by number", Options{Fields: []int{2}, Header: true}, "id,name,id\n2,b,1\n3,c,2\n1,a,3\n", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := trySort(in, tt.opts)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Errorf("Sort error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("Sort = %q, %v; want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestByLength(t *testing.T) {
+	tests := []struct {
+		name, in string
+		opts     Options
+		want     string
+	}{
+		{"shortest first", "aaa\na\naa\n", Options{ByLength: true}, "a\naa\naaa\n"},
+		{"longest first", "aaa\na\naa\n", Options{ByLength: true, Order: Descending}, "aaa\naa\na\n"},
+		{"ties by value", "bb\nc\nab\na\n", Options{ByLength: true}, "a\nc\nab\nbb\n"},
+		{"characters not bytes", "ééé\nabcd\n", Options{ByLength: true}, "ééé\nabcd\n"},
+		{"second field", "x,aaa\ny,a\n", Options{ByLength: true, Fields: []int{1}}, "y,a\nx,aaa\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sortString(t, tt.in, tt.opts); got != tt.want {
+				t.Errorf("Sort = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFirstUnsorted(t *testing.T) {
+	tests := []struct {
+		name string
+		rows [][]string
+		opts Options
+		want int
+		err  string
+	}{
+		{"sorted", [][]string{{"a"}, {"b"}, {"b"}}, Options{}, 0, ""},
+		{"unsorted", [][]string{{"a"}, {"c"}, {"b"}}, Options{}, 3, ""},
+		{"header counted", [][]string{{"k"}, {"a"}, {"c"}, {"b"}}, Options{Header: true}, 4, ""},
+		{"header not checked", [][]string{{"z"}, {"a"}, {"b"}}, Options{Header: true}, 0, ""},
+		{"descending", [][]string{{"c"}, {"b"}, {"a"}}, Options{Order: Descending}, 0, ""},
+		{"not descending", [][]string{{"c"}, {"a"}, {"b"}}, Options{Order: Descending}, 3, ""},
+		{"numeric", [][]string{{"9"}, {"10"}}, Options{Numeric: true}, 0, ""},
+		{"repeated with Unique", [][]string{{"a"}, {"b"}, {"b"}}, Options{Unique: true}, 3, ""},
+		{"empty", nil, Options{}, 0, ""},
+		{"field out of range", [][]string{{"a"}}, Options{Fields: []int{3}}, 0, "field 3 out of range (file has 1 columns)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := FirstUnsorted(rowsNext(tt.rows), tt.opts)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Errorf("FirstUnsorted error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("FirstUnsorted = %d, %v; want %d", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestHashSort(t *testing.T) {
+	keys := []string{"a", "b", "c", "d", "e", "f", "g"}
+	byHash := append([]string(nil), keys...)
+	sort.Slice(byHash, func(i, j int) bool { return fnvHash(byHash[i]) < fnvHash(byHash[j]) })
+	var want strings.Builder
+	for _, k := range byHash {
+		fmt.Fprintf(&want, "%s,%d\n", k, fnvHash(k)%3)
+	}
+	tests := []struct {
+		name, in string
+	}{
+		{"in order", strings.Join(keys, "\n") + "\n"},
+		{"reversed", "g\nf\ne\nd\nc\nb\na\n"},
+		{"shuffled", "d\na\ng\nc\nf\nb\ne\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := Options{Hash: true, Buckets: 3}
+			first := sortString(t, tt.in, opts)
+			if again := sortString(t, tt.in, opts); again != first {
+				t.Errorf("two runs gave %q and %q", first, again)
+			}
+			if first != want.String() {
+				t.Errorf("Sort = %q, want %q", first, want.String())
+			}
+		})
+	}
+}
+
+func TestBuckets(t *testing.T) {
+	tests := []struct {
+		name, in string
+		opts     Options
+		want     string
+	}{
+		{"header", "k\na\nb\n", Options{Header: true, Buckets: 2}, fmt.Sprintf("k,bucket\na,%d\nb,%d\n", fnvHash("a")%2, fnvHash("b")%2)},
+		{"second field", "x,a\ny,b\n", Options{Fields: []int{1}, Buckets: 5}, fmt.Sprintf("x,a,%d\ny,b,%d\n", fnvHash("a")%5, fnvHash("b")%5)},
+		{"one bucket", "b\na\n", Options{Buckets: 1}, "a,0\nb,0\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sortString(t, tt.in, tt.opts); got != tt.want {
+				t.Errorf("Sort = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNegativeFields(t *testing.T) {
+	const in = "b,x,3\nc,y,1\na,z,2\n"
+	tests := []struct {
+		name               string
+		negative, positive []int
+	}{
+		{"last", []int{-1}, []int{2}},
+		{"second to last", []int{-2}, []int{1}},
+		{"first", []int{-3}, []int{0}},
+		{"tie breaker", []int{-1, -3}, []int{2, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, alg := range Algorithms() {
+				got := sortString(t, in, Options{Fields: tt.negative, Algorithm: alg})
+				want := sortString(t, in, Options{Fields: tt.positive, Algorithm: alg})
+				if got != want {
+					t.Errorf("%s sort by %v = %q, by %v = %q", alg, tt.negative, got, tt.positive, want)
+				}
+			}
+		})
+	}
+	if got := sortString(t, in, Options{Fields: []int{-1}}); got != "c,y,1\na,z,2\nb,x,3\n" {
+		t.Errorf("Sort by -1 = %q", got)
+	}
+}
+
+func TestGroupBy(t *testing.T) {
+	const in = "b,x,2\na,y,1\nb,z,3\nc,w,4\na,v,1.5\n"
+	tests := []struct {
+		name string
+		in   string
+		opts Options
+		want string
+	}{
+		{"sum", in, Options{GroupBy: []int{0}, Aggs: []Aggregate{{"sum", 2}}}, "a,y,2.5\nb,x,5\nc,w,4\n"},
+		{"count", in, Options{GroupBy: []int{0}, Aggs: []Aggregate{{"count", 2}}}, "a,y,2\nb,x,2\nc,w,1\n"},
+		{"sum and count", in, Options{GroupBy: []int{0}, Aggs: []Aggregate{{"count", 1}, {"sum", 2}}}, "a,2,2.5\nb,2,5\nc,1,4\n"},
+		{"last", in, Options{Fields: []int{0, 1}, GroupBy: []int{0}, Aggs: []Aggregate{{"last", 1}}}, "a,y,1.5\nb,z,2\nc,w,4\n"},
+		{"no aggregation", in, Options{GroupBy: []int{0}}, "a,y,1\nb,x,2\nc,w,4\n"},
+		{"header", "k,n\nb,2\na,1\nb,3\n", Options{Header: true, GroupBy: []int{0}, Aggs: []Aggregate{{"sum", 1}}}, "k,n\na,1\nb,5\n"},
+		{"single row", "a,1\n", Options{GroupBy: []int{0}, Aggs: []Aggregate{{"sum", 1}, {"count", 0}}}, "1,1\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sortString(t, tt.in, tt.opts); got != tt.want {
+				t.Errorf("Sort = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGroupByErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		opts Options
+		want string
+	}{
+		{"not a number", "a,1\na,x\n", Options{GroupBy: []int{0}, Aggs: []Aggregate{{"sum", 1}}}, `field 1 is not a number: "x"`},
+		{"unknown aggregation", "a,1\n", Options{GroupBy: []int{0}, Aggs: []Aggregate{{"avg", 1}}}, `unknown aggregation "avg"`},
+		{"no group", "a,1\n", Options{Aggs: []Aggregate{{"sum", 1}}}, "aggregations need fields to group by"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := trySort(tt.in, tt.opts)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Sort error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestOrder(t *testing.T) {
+	const in = "b,1\na,2\nc,3\nb,4\na,5\n"
+	tests := []struct {
+		name string
+		opts Options
+		want string
+	}{
+		{"ascending by default", Options{Fields: []int{0}, Stable: true}, "a,2\na,5\nb,1\nb,4\nc,3\n"},
+		{"ascending", Options{Fields: []int{0}, Order: Ascending, Stable: true}, "a,2\na,5\nb,1\nb,4\nc,3\n"},
+		{"descending", Options{Fields: []int{0}, Order: Descending, Stable: true}, "c,3\nb,1\nb,4\na,2\na,5\n"},
+		{"descending numbers", Options{Fields: []int{1}, Numeric: true, Order: Descending}, "a,5\nb,4\nc,3\na,2\nb,1\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, alg := range Algorithms() {
+				opts := tt.opts
+				opts.Algorithm = alg
+				if got := sortString(t, in, opts); got != tt.want {
+					t.Errorf("%s sort = %q, want %q", alg, got, tt.want)
+				}
+			}
+		})
+	}
+	if _, err := trySort(in, Options{Order: Order(2)}); err == nil || err.Error() != "invalid order 2" {
+		t.Errorf("Sort with order 2 error = %v", err)
+	}
+}
+
+func TestLimit(t *testing.T) {
+	rows := [][]string{{"k"}, {"e"}, {"c"}, {"a"}, {"d"}, {"b"}}
+	tests := []struct {
+		name  string
+		opts  Options
+		want  [][]string
+		reads int
+	}{
+		{"no limit", Options{}, [][]string{{"a"}, {"b"}, {"c"}, {"d"}, {"e"}, {"k"}}, 6},
+		{"limit", Options{Limit: 3}, [][]string{{"c"}, {"e"}, {"k"}}, 3},
+		{"after the header", Options{Limit: 3, Header: true}, [][]string{{"k"}, {"a"}, {"c"}, {"e"}}, 4},
+		{"with head", Options{Limit: 3, Head: 1}, [][]string{{"c"}}, 3},
+		{"with a range", Options{Limit: 4, From: 2, To: 3}, [][]string{{"c"}, {"e"}}, 4},
+		{"detecting a header", Options{Limit: 2, AutoHeader: true}, [][]string{{"e"}, {"k"}}, 2},
+		{"larger than the input", Options{Limit: 100}, [][]string{{"a"}, {"b"}, {"c"}, {"d"}, {"e"}, {"k"}}, 6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reads := 0
+			next := rowsNext(rows)
+			counted := func() ([]string, bool) {
+				row, ok := next()
+				if ok {
+					reads++
+				}
+				return row, ok
+			}
+			rd, err := SortStream(counted, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rd.Close()
+			var got [][]string
+			for {
+				row, err := rd.Read()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, row)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("rows = %q, want %q", got, tt.want)
+			}
+			if reads != tt.reads {
+				t.Errorf("read %d rows, want %d", reads, tt.reads)
+			}
+		})
+	}
+	if _, err := trySort("a\n", Options{Limit: -1}); err == nil || err.Error() != "the row limit can't be negative" {
+		t.Errorf("Sort with limit -1 error = %v", err)
+	}
+}
+
+func TestSortRowsValidates(t *testing.T) {
+	rows := [][]string{{"b", "1"}, {"a", "2"}}
+	tests := []struct {
+		name string
+		opts Options
+		want string
+	}{
+		{"transpose with merge", Options{Algorithm: "merge", Transpose: true}, "the external merge sort can't transpose rows"},
+		{"shuffle with merge", Options{Algorithm: "merge", Shuffle: true}, "shuffling isn't supported by the external merge sort"},
+		{"ragged with merge", Options{Algorithm: "merge", Ragged: true}, "the external merge sort can't pad ragged rows"},
+		{"parallel tree", Options{Algorithm: "tree", Parallel: true}, "only the built in sort can run in parallel"},
+		{"unknown algorithm", Options{Algorithm: "bubble"}, `unknown sorting algorithm "bubble"`},
+		{"negative head", Options{Head: -1}, "the number of head or tail rows can't be negative"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := SortRows(rows, tt.opts)
+			if err == nil || !strings.HasPrefix(err.Error(), tt.want) {
+				t.Errorf("SortRows error = %v, want %q", err, tt.want)
+			}
+			_, err = SortStream(rowsNext(rows), tt.opts)
+			if err == nil || !strings.HasPrefix(err.Error(), tt.want) {
+				t.Errorf("SortStream error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
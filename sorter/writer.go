@@ -0,0 +1,276 @@
+package sorter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"unicode/utf8"
+)
+
+// RowWriter writes rows one at a time. Close writes out whatever is still
+// buffered, but leaves w open.
+type RowWriter interface {
+	Write(row []string) error
+	Close() error
+}
+
+// NewRowWriter returns the writer for the output format. Delimited output
+// uses the quote and, unless another one is set, the delimiter the input
+// was read with and quotes only the fields that need it, so reading it back
+// gives the same fields.
+func NewRowWriter(w io.Writer, opts Options) RowWriter {
+	switch opts.Format {
+	case "json":
+		return &jsonWriter{w: w}
+	case "json-objects":
+		return &jsonWriter{w: w, objects: true}
+	case "table":
+		return &tableWriter{w: tabwriter.NewWriter(w, 0, 8, 2, ' ', 0), eol: opts.lineEnd(), header: opts.HeaderRows(), max: opts.MaxWidth}
+	}
+	if opts.OutWidths != nil {
+		return &widthWriter{w: w, widths: opts.OutWidths, eol: opts.lineEnd()}
+	}
+	delim := opts.outDelimiter()
+	comma, ok := singleRune(delim)
+	if !ok {
+		return &splitWriter{w: w, delim: delim, eol: opts.lineEnd()}
+	}
+	quote := byte(opts.quote())
+	if quote != '"' {
+		w = &quoteWriter{w: w, quote: quote}
+	}
+	cw := csv.NewWriter(w)
+	cw.Comma = comma
+	cw.UseCRLF = opts.CRLF
+	return &csvWriter{Writer: cw, quote: quote}
+}
+
+func (o Options) lineEnd() string {
+	if o.CRLF {
+		return "\r\n"
+	}
+	return "\n"
+}
+
+// WriteRows writes the rows as they are read, in the format opts asks for.
+func WriteRows(w io.Writer, rows RowReader, opts Options) error {
+	bw := bufio.NewWriter(w)
+	rw := NewRowWriter(bw, opts)
+	for {
+		row, err := rows.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := rw.Write(row); err != nil {
+			return err
+		}
+	}
+	if err := rw.Close(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+type csvWriter struct {
+	*csv.Writer
+	quote byte
+}
+
+func (w *csvWriter) Write(row []string) error {
+	if w.quote != '"' {
+		swapped := make([]string, len(row))
+		for i, field := range row {
+			swapped[i] = swapQuote(field, w.quote)
+		}
+		row = swapped
+	}
+	return w.Writer.Write(row)
+}
+
+func (w *csvWriter) Close() error {
+	w.Flush()
+	return w.Error()
+}
+
+// quoteWriter swaps the double quotes encoding/csv writes with the quote,
+// the counterpart of quoteReader.
+type quoteWriter struct {
+	w     io.Writer
+	quote byte
+}
+
+func (q *quoteWriter) Write(p []byte) (int, error) {
+	b := append([]byte(nil), p...)
+	swapQuoteBytes(b, q.quote)
+	return q.w.Write(b)
+}
+
+// splitWriter joins fields with a multi-character delimiter, the
+// counterpart of splitReader.
+type splitWriter struct {
+	w     io.Writer
+	delim string
+	eol   string
+}
+
+func (w *splitWriter) Write(row []string) error {
+	_, err := io.WriteString(w.w, strings.Join(row, w.delim)+w.eol)
+	return err
+}
+
+func (w *splitWriter) Close() error {
+	return nil
+}
+
+// widthWriter pads fields to fixed widths, the counterpart of reading with
+// widths. Longer fields are written whole and the last one isn't padded.
+type widthWriter struct {
+	w      io.Writer
+	widths []int
+	eol    string
+}
+
+func (w *widthWriter) Write(row []string) error {
+	var b strings.Builder
+	for i, field := range row {
+		b.WriteString(field)
+		if i < len(row)-1 && i < len(w.widths) {
+			b.WriteString(strings.Repeat(" ", max(w.widths[i]-len(field), 0)))
+		}
+	}
+	_, err := io.WriteString(w.w, strings.TrimRight(b.String(), " ")+w.eol)
+	return err
+}
+
+func (w *widthWriter) Close() error {
+	return nil
+}
+
+// tableWriter aligns the fields in columns padded with spaces, for reading
+// rather than parsing. A header is followed by a divider as wide as each
+// column, so all the rows are kept until Close.
+type tableWriter struct {
+	w      *tabwriter.Writer
+	eol    string
+	header int // rows above the divider
+	max    int // cells are cut to max characters if not 0
+	rows   [][]string
+	widths []int
+}
+
+// cellSpace replaces what would break the alignment of a cell.
+var cellSpace = strings.NewReplacer("\t", " ", "\r", " ", "\n", " ")
+
+func (w *tableWriter) Write(row []string) error {
+	cells := make([]string, len(row))
+	for i, field := range row {
+		cell := cellSpace.Replace(field)
+		if w.max > 0 && utf8.RuneCountInString(cell) > w.max {
+			cell = string([]rune(cell)[:w.max-1]) + "…"
+		}
+		cells[i] = cell
+		if i == len(w.widths) {
+			w.widths = append(w.widths, 0)
+		}
+		w.widths[i] = max(w.widths[i], utf8.RuneCountInString(cell))
+	}
+	w.rows = append(w.rows, cells)
+	return nil
+}
+
+func (w *tableWriter) Close() error {
+	for i, cells := range w.rows {
+		if _, err := io.WriteString(w.w, strings.Join(cells, "\t")+w.eol); err != nil {
+			return err
+		}
+		if i == w.header-1 {
+			divider := make([]string, len(w.widths))
+			for j, n := range w.widths {
+				divider[j] = strings.Repeat("-", n)
+			}
+			if _, err := io.WriteString(w.w, strings.Join(divider, "\t")+w.eol); err != nil {
+				return err
+			}
+		}
+	}
+	w.rows = nil
+	return w.w.Flush()
+}
+
+// jsonWriter writes an indented JSON array of rows, either as arrays or as
+// objects keyed by the fields of the first row.
+type jsonWriter struct {
+	w       io.Writer
+	objects bool
+	keys    []string
+	n       int
+}
+
+func (w *jsonWriter) Write(row []string) error {
+	var v any = row
+	if w.objects {
+		if w.keys == nil {
+			w.keys = row
+			return nil
+		}
+		v = jsonObject{keys: w.keys, values: row}
+	}
+	b, err := json.MarshalIndent(v, "  ", "  ")
+	if err != nil {
+		return err
+	}
+	sep := ",\n  "
+	if w.n == 0 {
+		sep = "[\n  "
+	}
+	w.n++
+	_, err = fmt.Fprint(w.w, sep, string(b))
+	return err
+}
+
+func (w *jsonWriter) Close() error {
+	end := "\n]\n"
+	if w.n == 0 {
+		end = "[]\n"
+	}
+	_, err := fmt.Fprint(w.w, end)
+	return err
+}
+
+// jsonObject is a row encoded as an object keyed by the header fields,
+// keeping the order of the columns.
+type jsonObject struct {
+	keys   []string
+	values []string
+}
+
+func (o jsonObject) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, key := range o.keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		k, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		v, err := json.Marshal(o.values[i])
+		if err != nil {
+			return nil, err
+		}
+		b.Write(k)
+		b.WriteByte(':')
+		b.Write(v)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
@@ -0,0 +1,269 @@
+package sorter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestJSONFormats(t *testing.T) {
+	const in = "name,n\nb,2\na,1\n"
+	tests := []struct {
+		name string
+		opts Options
+		want any
+	}{
+		{"arrays", Options{Format: "json"}, []any{[]any{"a", "1"}, []any{"b", "2"}, []any{"name", "n"}}},
+		{"arrays with a header", Options{Format: "json", Header: true}, []any{[]any{"name", "n"}, []any{"a", "1"}, []any{"b", "2"}}},
+		{"objects", Options{Format: "json-objects", Header: true}, []any{
+			map[string]any{"name": "a", "n": "1"},
+			map[string]any{"name": "b", "n": "2"},
+		}},
+		{"empty", Options{Format: "json"}, []any{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := in
+			if tt.name == "empty" {
+				input = ""
+			}
+			var got any
+			out := sortString(t, input, tt.opts)
+			if err := json.Unmarshal([]byte(out), &got); err != nil {
+				t.Fatalf("output %q isn't JSON: %v", out, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("output = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJSONObjectsNeedHeader(t *testing.T) {
+	_, err := trySort("name,n\nb,2\n", Options{Format: "json-objects"})
+	if want := "the json-objects format needs a header to take the keys from"; err == nil || err.Error() != want {
+		t.Errorf("Sort error = %v, want %q", err, want)
+	}
+}
+
+// failingReader returns its rows and then err.
+type failingReader struct {
+	rows [][]string
+	err  error
+}
+
+func (f *failingReader) Read() ([]string, error) {
+	if len(f.rows) == 0 {
+		return nil, f.err
+	}
+	row := f.rows[0]
+	f.rows = f.rows[1:]
+	return row, nil
+}
+
+func TestWriteRows(t *testing.T) {
+	failed := errors.New("read failed")
+	tests := []struct {
+		name    string
+		rows    [][]string
+		err     error
+		want    string
+		wantErr error
+	}{
+		{"all rows", [][]string{{"a", "1"}, {"b", "2"}}, io.EOF, "a,1\nb,2\n", nil},
+		{"no rows", nil, io.EOF, "", nil},
+		{"read error", [][]string{{"a", "1"}}, failed, "", failed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			err := WriteRows(&out, &failingReader{rows: tt.rows, err: tt.err}, Options{})
+			if err != tt.wantErr {
+				t.Fatalf("WriteRows error = %v, want %v", err, tt.wantErr)
+			}
+			if out.String() != tt.want {
+				t.Errorf("WriteRows wrote %q, want %q", out.String(), tt.want)
+			}
+		})
+	}
+}
+
+// benchInput returns n rows of CSV in descending order.
+func benchInput(n int) string {
+	var b strings.Builder
+	for i := n; i > 0; i-- {
+		fmt.Fprintf(&b, "%08d,some text in the second field\n", i)
+	}
+	return b.String()
+}
+
+// BenchmarkOutput compares writing the sorted rows as they are read with
+// reading them all into a slice first.
+func BenchmarkOutput(b *testing.B) {
+	in := benchInput(100000)
+	b.Run("streamed", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := Sort(strings.NewReader(in), io.Discard, Options{}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("buffered", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			rd, err := NewReader(strings.NewReader(in), Options{})
+			if err != nil {
+				b.Fatal(err)
+			}
+			rows, err := rd.ReadAll()
+			if err != nil {
+				b.Fatal(err)
+			}
+			sorted, err := SortRows(rows, Options{})
+			if err != nil {
+				b.Fatal(err)
+			}
+			var all [][]string
+			for row, err := sorted.Read(); err == nil; row, err = sorted.Read() {
+				all = append(all, row)
+			}
+			sorted.Close()
+			if err := WriteRows(io.Discard, &sliceReader{rows: all}, Options{}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestFormats(t *testing.T) {
+	const in = "name,n\nbob,10\nal,2\n"
+	tests := []struct {
+		format string
+		opts   Options
+		want   string
+	}{
+		{"csv", Options{}, "name,n\nal,2\nbob,10\n"},
+		{"tsv", Options{}, "name\tn\nal\t2\nbob\t10\n"},
+		{"json", Options{}, "[\n  [\n    \"name\",\n    \"n\"\n  ],\n  [\n    \"al\",\n    \"2\"\n  ],\n  [\n    \"bob\",\n    \"10\"\n  ]\n]\n"},
+		{"json-objects", Options{}, "[\n  {\n    \"name\": \"al\",\n    \"n\": \"2\"\n  },\n  {\n    \"name\": \"bob\",\n    \"n\": \"10\"\n  }\n]\n"},
+		{"table", Options{}, "name  n\n----  --\nal    2\nbob   10\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			opts := tt.opts
+			opts.Format, opts.Header = tt.format, true
+			if got := sortString(t, in, opts); got != tt.want {
+				t.Errorf("Sort = %q, want %q", got, tt.want)
+			}
+		})
+	}
+	invalid := []struct {
+		opts Options
+		err  string
+	}{
+		{Options{Format: "xml"}, `unknown output format "xml"`},
+		{Options{Format: "json", OutDelim: ";"}, "the json format has no output delimiter or widths"},
+	}
+	for _, tt := range invalid {
+		if _, err := trySort(in, tt.opts); err == nil || err.Error() != tt.err {
+			t.Errorf("Sort error = %v, want %q", err, tt.err)
+		}
+	}
+}
+
+func TestTableFormat(t *testing.T) {
+	tests := []struct {
+		name, in string
+		opts     Options
+		want     []string
+	}{
+		{"header", "name,n\nbobby,10\nal,2\n", Options{Header: true}, []string{
+			"name   n",
+			"-----  --",
+			"al     2",
+			"bobby  10",
+		}},
+		{"no header", "bobby,10\nal,2\n", Options{}, []string{
+			"al     2",
+			"bobby  10",
+		}},
+		{"cut", "name,n\nbobbybobby,10\nal,2\n", Options{Header: true, MaxWidth: 4}, []string{
+			"name  n",
+			"----  --",
+			"al    2",
+			"bob…  10",
+		}},
+		{"wide characters", "name,n\nzoë,1\nal,2\n", Options{Header: true}, []string{
+			"name  n",
+			"----  -",
+			"al    2",
+			"zoë   1",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			opts.Format = "table"
+			got := sortString(t, tt.in, opts)
+			if want := strings.Join(tt.want, "\n") + "\n"; got != want {
+				t.Errorf("Sort = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name, in string
+		opts     Options
+		want     string // what is written back, the input if empty
+	}{
+		{"plain", "b,1\na,2\n", Options{}, ""},
+		{"quoted delimiter", "\"a,b\",1\nc,2\n", Options{}, ""},
+		{"quoted quotes", "\"say \"\"hi\"\"\",1\n", Options{}, ""},
+		{"quoted newline", "\"two\nlines\",1\n", Options{}, ""},
+		{"empty fields", ",1\na,\n", Options{}, ""},
+		{"semicolons", "a;\"x;y\";b,c\n", Options{Delimiter: ";"}, ""},
+		{"tabs", "a\t\"b\tc\"\td e\n", Options{Delimiter: "\t"}, ""},
+		{"quotes only as needed", "\"a\",\"1\"\n", Options{}, "a,1\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rd, err := NewReader(strings.NewReader(tt.in), tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rows, err := rd.ReadAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var out strings.Builder
+			if err := WriteRows(&out, &failingReader{rows: rows, err: io.EOF}, tt.opts); err != nil {
+				t.Fatal(err)
+			}
+			want := tt.want
+			if want == "" {
+				want = tt.in
+			}
+			if out.String() != want {
+				t.Errorf("wrote %q, want %q", out.String(), want)
+			}
+			rd, err = NewReader(strings.NewReader(out.String()), tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			again, err := rd.ReadAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(again, rows) {
+				t.Errorf("read back %q, want %q", again, rows)
+			}
+		})
+	}
+}